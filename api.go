@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type ApiError struct {
+	Error string `json:"error"`
+}
+
+type ApiRobot struct {
+	Id          string    `json:"id"`
+	Name        string    `json:"name"`
+	Address     string    `json:"address"`
+	Connected   bool      `json:"connected"`
+	LastMessage time.Time `json:"last_message"`
+}
+
+type ApiState struct {
+	ApiRobot
+	State        string                 `json:"state"`
+	BatteryLevel int                    `json:"battery_level"`
+	Attributes   map[string]interface{} `json:"attributes"`
+	Reported     map[string]interface{} `json:"reported"`
+}
+
+type ApiRegion struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Selected bool   `json:"selected"`
+}
+
+type ApiMap struct {
+	Id      string      `json:"id"`
+	Name    string      `json:"name"`
+	Regions []ApiRegion `json:"regions"`
+}
+
+// ApiCommand is the body of POST /api/robots/<blid>/command. MapId, Regions
+// and TwoPass are only used by the rooms command, regions selected with the
+// region switches are cleaned when Regions is empty.
+type ApiCommand struct {
+	Command string   `json:"command"`
+	MapId   string   `json:"map_id"`
+	Regions []string `json:"regions"`
+	TwoPass bool     `json:"two_pass"`
+}
+
+func (self *Client) ApiRobot() ApiRobot {
+	return ApiRobot{
+		Id:          self.Id(),
+		Name:        self.HomeAssistant.Vacuum.Config.Name,
+		Address:     self.MqttConfig.Broker,
+		Connected:   self.Connected,
+		LastMessage: self.LastMessage,
+	}
+}
+
+func (self *Client) ApiState() ApiState {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return_value := ApiState{
+		ApiRobot:     self.ApiRobot(),
+		State:        self.HomeAssistant.Vacuum.State.State,
+		BatteryLevel: self.HomeAssistant.Vacuum.State.BatteryLevel,
+		Attributes:   map[string]interface{}{},
+		Reported:     map[string]interface{}{},
+	}
+	// copy so the response is not encoded while the robot update them
+	MergeShadow(return_value.Attributes, self.HomeAssistant.Vacuum.Attributes)
+	MergeShadow(return_value.Reported, self.Shadow)
+	return return_value
+}
+
+func (self *Client) ApiMaps() []ApiMap {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return_value := []ApiMap{}
+	for m := range self.Maps {
+		api_map := ApiMap{
+			Id:      self.Maps[m].Id,
+			Name:    self.Maps[m].Name,
+			Regions: []ApiRegion{},
+		}
+		for _, region := range self.Maps[m].Regions {
+			api_region := ApiRegion{
+				Id:   region.Id,
+				Name: region.Name,
+				Type: region.Type,
+			}
+			for i := range self.HomeAssistant.RegionSwitches {
+				if self.HomeAssistant.RegionSwitches[i].Region == region {
+					api_region.Selected = bool(self.HomeAssistant.RegionSwitches[i].State)
+				}
+			}
+			api_map.Regions = append(api_map.Regions, api_region)
+		}
+		sort.Slice(api_map.Regions, func(i, j int) bool {
+			return api_map.Regions[i].Id < api_map.Regions[j].Id
+		})
+		return_value = append(return_value, api_map)
+	}
+	return return_value
+}
+
+// ApiRegions resolve the region ids of a rooms command
+func (self *Client) ApiRegions(cmd ApiCommand) (string, []RoombaRegion, *ApiError) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if len(cmd.Regions) == 0 {
+		return "", nil, nil
+	}
+	for m := range self.Maps {
+		if self.Maps[m].Id != cmd.MapId {
+			continue
+		}
+		regions := []RoombaRegion{}
+		for i := range cmd.Regions {
+			region, ok := self.Maps[m].Regions[cmd.Regions[i]]
+			if !ok {
+				return "", nil, &ApiError{Error: "unknown region " + cmd.Regions[i]}
+			}
+			regions = append(regions, NewRoombaRegion(region, cmd.TwoPass))
+		}
+		return cmd.MapId, regions, nil
+	}
+	return "", nil, &ApiError{Error: "unknown map " + cmd.MapId}
+}
+
+func ApiRobotsHandler(w http.ResponseWriter, r *http.Request) {
+	robots := []ApiRobot{}
+	for i := range vacuum_client_list {
+		vacuum_client_list[i].mutex.Lock()
+		robots = append(robots, vacuum_client_list[i].ApiRobot())
+		vacuum_client_list[i].mutex.Unlock()
+	}
+	WriteJson(w, http.StatusOK, robots)
+}
+
+// ApiRobotHandler serve the robot API, the posts must be application/json
+//
+//	GET  /api/robots/<blid>/state
+//	GET  /api/robots/<blid>/maps
+//	POST /api/robots/<blid>/command
+//	GET  /api/robots/<blid>/capture
+//	POST /api/robots/<blid>/capture
+func ApiRobotHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/robots/"), "/"), "/")
+
+	client := FindClient(parts[0])
+	if client == nil {
+		WriteJson(w, http.StatusNotFound, ApiError{Error: "unknown robot"})
+		return
+	}
+	if len(parts) != 2 {
+		WriteJson(w, http.StatusNotFound, ApiError{Error: "not found"})
+		return
+	}
+
+	method := http.MethodGet
+	if parts[1] == "command" || (parts[1] == "capture" && r.Method == http.MethodPost) {
+		method = http.MethodPost
+	}
+	if r.Method != method {
+		WriteJson(w, http.StatusMethodNotAllowed, ApiError{Error: "method not allowed"})
+		return
+	}
+	// a cross-site form can not post JSON without a preflight request
+	if media_type, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); method == http.MethodPost && media_type != "application/json" {
+		WriteJson(w, http.StatusUnsupportedMediaType, ApiError{Error: "Content-Type must be application/json"})
+		return
+	}
+
+	switch parts[1] {
+	case "state":
+		WriteJson(w, http.StatusOK, client.ApiState())
+	case "maps":
+		WriteJson(w, http.StatusOK, client.ApiMaps())
+	case "command":
+		ApiCommandHandler(client, w, r)
+	case "capture":
+		ApiCaptureHandler(client, w, r)
+	default:
+		WriteJson(w, http.StatusNotFound, ApiError{Error: "not found"})
+	}
+}
+
+func ApiCommandHandler(client *Client, w http.ResponseWriter, r *http.Request) {
+	cmd := ApiCommand{}
+	err := json.NewDecoder(r.Body).Decode(&cmd)
+	if err != nil {
+		WriteJson(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+		return
+	}
+	if !client.IsConnected() {
+		WriteJson(w, http.StatusServiceUnavailable, ApiError{Error: "robot is not connected"})
+		return
+	}
+
+	pmap_id, regions, api_err := client.ApiRegions(cmd)
+	if api_err != nil {
+		WriteJson(w, http.StatusBadRequest, api_err)
+		return
+	}
+
+	log.Info().Str("roomba", client.LockedId()).Str("command", cmd.Command).Msg("API command")
+	err = WaitCommand(r.Context(), client.Loop.Queue(RobotCommand{
+		Command: cmd.Command,
+		PmapId:  pmap_id,
+		Regions: regions,
+	}))
+	if err != nil {
+		WriteJson(w, commandErrorStatus(err), ApiError{Error: err.Error()})
+		return
+	}
+	WriteJson(w, http.StatusOK, cmd)
+}
+
+// commandErrorStatus return 504 when the robot did not confirm the command,
+// 503 when it can not be reached and 400 for an invalid command
+func commandErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrRobotTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrRobotDisconnected), errors.Is(err, ErrCommandQueueFull):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+// ApiCapture is the state of the debug capture of a robot
+type ApiCapture struct {
+	Enabled bool `json:"enabled"`
+}
+
+func ApiCaptureHandler(client *Client, w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		capture := ApiCapture{}
+		err := json.NewDecoder(r.Body).Decode(&capture)
+		if err != nil {
+			WriteJson(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+			return
+		}
+		client.Loop.Call(func() {
+			capture_switch := client.HomeAssistant.CaptureSwitch
+			payload := capture_switch.Config.PayloadOff
+			if capture.Enabled {
+				payload = capture_switch.Config.PayloadOn
+			}
+			capture_switch.OnCommand(capture_switch.Config.CommandTopic, []byte(payload))
+		})
+	}
+	WriteJson(w, http.StatusOK, ApiCapture{Enabled: client.Capture.IsEnabled()})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandErrorStatus(t *testing.T) {
+	_, invalid := CommandSequence("fly", "charge", "", nil)
+	_, no_region := CommandSequence("rooms", "charge", "", nil)
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{invalid, http.StatusBadRequest},
+		{no_region, http.StatusBadRequest},
+		{fmt.Errorf("%w: start not confirmed", ErrRobotTimeout), http.StatusGatewayTimeout},
+		{ErrRobotDisconnected, http.StatusServiceUnavailable},
+		{fmt.Errorf("%w: %s", ErrRobotDisconnected, errors.New("EOF")), http.StatusServiceUnavailable},
+		{ErrCommandQueueFull, http.StatusServiceUnavailable},
+	}
+	for i := range tests {
+		if got := commandErrorStatus(tests[i].err); got != tests[i].status {
+			t.Errorf("commandErrorStatus(%v) = %d, want %d", tests[i].err, got, tests[i].status)
+		}
+	}
+}
+
+// TestApiCommand send commands to a simulated robot through the API, the
+// robot does not move so evacuate wait for the dock until the timeout
+func TestApiCommand(t *testing.T) {
+	dock_timeout := COMMAND_DOCK_TIMEOUT
+	COMMAND_DOCK_TIMEOUT = 200 * time.Millisecond
+	t.Cleanup(func() { COMMAND_DOCK_TIMEOUT = dock_timeout })
+
+	_, config := startSimulatedRobot(t)
+	master := NewFakeMqttClient()
+	master.Connect()
+	startBridge(t, config, master)
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`command=start`, http.StatusUnsupportedMediaType},
+		{`{"command":`, http.StatusBadRequest},
+		{`{"command":"fly"}`, http.StatusBadRequest},
+		{`{"command":"start"}`, http.StatusOK},
+		{`{"command":"stop"}`, http.StatusOK},
+		{`{"command":"evacuate"}`, http.StatusGatewayTimeout},
+	}
+	for i := range tests {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/api/robots/"+test_blid+"/command", strings.NewReader(tests[i].body))
+		if strings.HasPrefix(tests[i].body, "{") {
+			request.Header.Set("Content-Type", "application/json; charset=utf-8")
+		} else {
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		ApiRobotHandler(recorder, request)
+		if recorder.Code != tests[i].status {
+			t.Errorf("%s: status %d, want %d: %s", tests[i].body, recorder.Code, tests[i].status, recorder.Body.String())
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Buttons of the robot, each press run the vacuum command sequence. The
+// filter counter can not be reset through the local MQTT interface, no button
+// is announced for it.
+var robot_buttons = []struct {
+	Id         string
+	Name       string
+	Command    string
+	Icon       string
+	Capability string
+}{
+	{"empty_bin", "Empty bin", "evacuate", "mdi:delete-empty", "evac"},
+	{"locate", "Locate", "locate", "mdi:map-marker-question", "find"},
+	{"train_map", "Train map", "train", "mdi:map-search", "mapping"},
+	{"clean_rooms", "Clean selected rooms", "rooms", "mdi:floor-plan", "mapping"},
+}
+
+// Clean Base models have a 5 as second digit of the SKU: i755020, s955020
+var clean_base_sku = regexp.MustCompile(`^[a-zA-Z][0-9]5`)
+
+// Models with maps: i, s, j and combo (c) series. The 600 to 900 series have
+// a R SKU and the e series (e515020) do not map.
+var mapping_sku = regexp.MustCompile(`^[iIsSjJcC][0-9]`)
+
+// SkuSupports tell if a robot model has a capability. Only the models with
+// maps find themselves, train maps and have a Clean Base.
+func SkuSupports(sku string, capability string) bool {
+	if !mapping_sku.MatchString(sku) {
+		return false
+	}
+	switch capability {
+	case "evac":
+		return clean_base_sku.MatchString(sku)
+	case "find", "mapping":
+		return true
+	}
+	return false
+}
+
+func (self *HomeAssistant) ConfigureButton(device_id string, button_id string, dev *Device, icon string) *Button {
+	return_value := &Button{
+		Entity: Entity{
+			HomeAssistant: self,
+			Component:     "button",
+			DeviceId:      device_id,
+			ObjectId:      button_id,
+			Attributes:    make(map[string]interface{}),
+		},
+		Config: ButtonConfig{
+			Name:         button_id,
+			PayloadPress: "PRESS",
+			Device:       dev,
+			Icon:         icon,
+		},
+	}
+	return_value.ConfigTopic = self.DiscoveryTopic(&return_value.Entity)
+	return_value.Config.UniqueId = return_value.UniqueId()
+	return_value.SetBaseTopic(self.EntityTopic(&return_value.Entity))
+	return_value.OnCommand = return_value.CommandHandler
+
+	self.Entities = append(self.Entities, return_value)
+	return_value.NeedSendConfig = true
+
+	return return_value
+}
+
+// ConfigureButtons announce the buttons the robot model supports and remove
+// the others, return true when a button was removed
+func (self *HomeAssistant) ConfigureButtons(device_id string, dev *Device, sku string) bool {
+	if self.Buttons == nil {
+		self.Buttons = map[string]*Button{}
+	}
+	removed := false
+	for i := range robot_buttons {
+		definition := robot_buttons[i]
+		button, found := self.Buttons[definition.Id]
+		supported := SkuSupports(sku, definition.Capability)
+		if supported && !found {
+			button = self.ConfigureButton(device_id, definition.Id, dev, definition.Icon)
+			button.Config.Name = definition.Name
+			button.Command = definition.Command
+			self.Buttons[definition.Id] = button
+		} else if !supported && found {
+			self.RemoveButton(button)
+			removed = true
+		}
+	}
+	self.SubscribeCommands()
+	return removed
+}
+
+// RemoveButton forget a button, its retained messages are cleared by the
+// next cleanup
+func (self *HomeAssistant) RemoveButton(button *Button) {
+	delete(self.Buttons, button.ObjectId)
+	for i := range self.Entities {
+		if self.Entities[i] == button {
+			self.Entities = append(self.Entities[:i], self.Entities[i+1:]...)
+			break
+		}
+	}
+}
+
+func (self *Button) CommandHandler(topic string, payload []byte) {
+	if string(payload) != self.Config.PayloadPress {
+		return
+	}
+	log.Info().Str("button", self.ObjectId).Str("command", self.Command).Msg("Button pressed")
+	self.HomeAssistant.Loop.Queue(RobotCommand{Command: self.Command})
+}
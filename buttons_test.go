@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSkuSupports(t *testing.T) {
+	tests := []struct {
+		sku     string
+		evac    bool
+		mapping bool
+	}{
+		{"", false, false},
+		{"R980020", false, false},
+		{"R675020", false, false},
+		{"e515020", false, false},
+		{"e5", false, false},
+		{"i315020", false, true},
+		{"i355020", true, true},
+		{"i755020", true, true},
+		{"s955020", true, true},
+		{"j755020", true, true},
+		{"j715020", false, true},
+		{"c755020", true, true},
+	}
+	for i := range tests {
+		if got := SkuSupports(tests[i].sku, "evac"); got != tests[i].evac {
+			t.Errorf("SkuSupports(%q, evac) = %t, want %t", tests[i].sku, got, tests[i].evac)
+		}
+		for _, capability := range []string{"find", "mapping"} {
+			if got := SkuSupports(tests[i].sku, capability); got != tests[i].mapping {
+				t.Errorf("SkuSupports(%q, %s) = %t, want %t", tests[i].sku, capability, got, tests[i].mapping)
+			}
+		}
+	}
+}
+
+// TestButtonsKeptOnRestart check that the retained configs of the buttons are
+// not cleared when the robot does not report its SKU in the first message
+func TestButtonsKeptOnRestart(t *testing.T) {
+	DATA_FOLDER = t.TempDir()
+	DEBUG_FOLDER = ""
+	retained_registry = LoadRetainedRegistry(DATA_FOLDER)
+	t.Cleanup(func() { retained_registry = nil })
+
+	button_topic := "homeassistant/button/" + test_blid + "_empty_bin/button/config"
+	stale_topic := "homeassistant/button/" + test_blid + "_removed/button/config"
+	retained_registry.Published(button_topic, test_blid, []byte("{}"))
+	retained_registry.Published(stale_topic, test_blid, []byte("{}"))
+
+	topic := "$aws/things/" + test_blid + "/shadow/update"
+	master := NewFakeMqttClient()
+	master.Connect()
+	_, err := ReplayCapture(master, []CapturedMessage{
+		{Topic: topic, Payload: []byte(`{"state":{"reported":{"name":"Test Roomba","batPct":100}}}`)},
+		{Topic: topic, Payload: []byte(`{"state":{"reported":{"sku":"i755020"}}}`)},
+	}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cleared := map[string]bool{}
+	for _, message := range master.Messages() {
+		if message.Retain && len(message.Payload) == 0 {
+			cleared[message.Topic] = true
+		}
+	}
+	if cleared[button_topic] {
+		t.Errorf("%s cleared before the SKU was known", button_topic)
+	}
+	if !cleared[stale_topic] {
+		t.Errorf("%s not cleared", stale_topic)
+	}
+	if _, ok := master.Retained[button_topic]; !ok {
+		t.Errorf("%s not published", button_topic)
+	}
+}
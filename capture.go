@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Size of a capture file before it is rotated and number of rotated files
+// kept
+var CAPTURE_MAX_SIZE int64 = 10 * 1024 * 1024
+var CAPTURE_MAX_FILES = 3
+
+const (
+	capture_robot_in   = "robot_in"
+	capture_robot_out  = "robot_out"
+	capture_master_in  = "master_in"
+	capture_master_out = "master_out"
+)
+
+// CaptureRecord is a line of a capture file. Payload is the JSON payload
+// itself or a JSON string when the payload is not JSON. Qos and Retain are
+// only recorded for the published messages, the subscribe callbacks do not
+// receive them.
+type CaptureRecord struct {
+	Time      time.Time       `json:"time"`
+	Direction string          `json:"direction"`
+	Topic     string          `json:"topic"`
+	Qos       *uint8          `json:"qos,omitempty"`
+	Retain    *bool           `json:"retain,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// Keys whose values are replaced in the captured payloads
+var capture_redacted_key = regexp.MustCompile(`(?i)password|passwd|pwd|token|secret|credential`)
+
+// Capture write the MQTT traffic of a robot to DEBUG_FOLDER/<blid>.jsonl,
+// the rotated files are <blid>.jsonl.1 to <blid>.jsonl.<CAPTURE_MAX_FILES>
+type Capture struct {
+	FileName string
+	Enabled  bool
+	file     *os.File
+	size     int64
+	mutex    sync.Mutex
+}
+
+// NewCapture return the capture of a robot, enabled when the debug folder
+// exists like the previous text capture
+func NewCapture(folder string, blid string) *Capture {
+	return_value := &Capture{
+		FileName: path.Join(folder, blid+".jsonl"),
+	}
+	if _, err := os.Stat(folder); err == nil && folder != "" {
+		return_value.Enabled = true
+	}
+	return return_value
+}
+
+// SetRobotId move the capture to the file of the robot id once the robot
+// reports it, the traffic captured before is kept in it
+func (self *Capture) SetRobotId(blid string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	file_name := path.Join(path.Dir(self.FileName), blid+".jsonl")
+	if file_name == self.FileName {
+		return
+	}
+	self.close()
+	if _, err := os.Stat(self.FileName); err == nil {
+		if _, err := os.Stat(file_name); os.IsNotExist(err) {
+			err = os.Rename(self.FileName, file_name)
+			if err != nil {
+				log.Error().Err(err).Str("file_name", file_name).Msg("Debug capture")
+			}
+		}
+	}
+	self.FileName = file_name
+}
+
+// Files return the names of the capture files on disk, the current one
+// first then the rotated ones from the most recent
+func (self *Capture) Files() []string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return_value := []string{}
+	names := []string{self.FileName}
+	for i := 1; i <= CAPTURE_MAX_FILES; i++ {
+		names = append(names, fmt.Sprintf("%s.%d", self.FileName, i))
+	}
+	for i := range names {
+		if _, err := os.Stat(names[i]); err == nil {
+			return_value = append(return_value, path.Base(names[i]))
+		}
+	}
+	return return_value
+}
+
+// Path return the path of a capture file listed by Files, "" when the name
+// is not a capture file of the robot
+func (self *Capture) Path(name string) string {
+	if !containsString(self.Files(), name) {
+		return ""
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return path.Join(path.Dir(self.FileName), name)
+}
+
+func (self *Capture) IsEnabled() bool {
+	if self == nil {
+		return false
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.Enabled
+}
+
+func (self *Capture) SetEnabled(enabled bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.Enabled != enabled {
+		log.Info().Str("file_name", self.FileName).Bool("enabled", enabled).Msg("Debug capture")
+	}
+	self.Enabled = enabled
+	if !enabled {
+		self.close()
+	}
+}
+
+func (self *Capture) close() {
+	if self.file != nil {
+		self.file.Close()
+		self.file = nil
+	}
+}
+
+// rotate shift the capture files, FileName.1 is the most recent
+func (self *Capture) rotate() {
+	self.close()
+	os.Remove(fmt.Sprintf("%s.%d", self.FileName, CAPTURE_MAX_FILES))
+	for i := CAPTURE_MAX_FILES - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", self.FileName, i), fmt.Sprintf("%s.%d", self.FileName, i+1))
+	}
+	if CAPTURE_MAX_FILES > 0 {
+		os.Rename(self.FileName, self.FileName+".1")
+	} else {
+		os.Remove(self.FileName)
+	}
+}
+
+func (self *Capture) open() error {
+	os.MkdirAll(path.Dir(self.FileName), 0755)
+	f, err := os.OpenFile(self.FileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	self.file = f
+	self.size = info.Size()
+	return nil
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key := range v {
+			if capture_redacted_key.MatchString(key) {
+				v[key] = "REDACTED"
+			} else {
+				v[key] = redactValue(v[key])
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+	}
+	return value
+}
+
+// CapturePayload return the payload as recorded: redacted JSON or a JSON
+// string
+func CapturePayload(payload []byte) json.RawMessage {
+	var value interface{}
+	if json.Unmarshal(payload, &value) == nil {
+		if _, ok := value.(string); !ok {
+			data, err := json.Marshal(redactValue(value))
+			if err == nil {
+				return data
+			}
+		}
+	}
+	data, _ := json.Marshal(string(payload))
+	return data
+}
+
+// Record append a received message to the capture
+func (self *Capture) Record(direction string, topic string, payload []byte) {
+	self.write(CaptureRecord{
+		Time:      time.Now(),
+		Direction: direction,
+		Topic:     topic,
+		Payload:   CapturePayload(payload),
+	})
+}
+
+// RecordPublish record a published message with its qos and retain flag
+func (self *Capture) RecordPublish(direction string, topic string, payload []byte, qos uint8, retain bool) {
+	self.write(CaptureRecord{
+		Time:      time.Now(),
+		Direction: direction,
+		Topic:     topic,
+		Qos:       &qos,
+		Retain:    &retain,
+		Payload:   CapturePayload(payload),
+	})
+}
+
+func (self *Capture) write(record CaptureRecord) {
+	if !self.IsEnabled() {
+		return
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Error().Err(err).Msg("Debug capture")
+		return
+	}
+	data = append(data, '\n')
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.file != nil && self.size+int64(len(data)) > CAPTURE_MAX_SIZE {
+		self.rotate()
+	}
+	if self.file == nil {
+		err = self.open()
+		if err != nil {
+			log.Error().Err(err).Str("file_name", self.FileName).Msg("Debug capture")
+			return
+		}
+	}
+	n, err := self.file.Write(data)
+	self.size += int64(n)
+	if err != nil {
+		log.Error().Err(err).Str("file_name", self.FileName).Msg("Debug capture")
+	}
+}
+
+// ParseCaptureRecord read a line of a capture file
+func ParseCaptureRecord(line string) (CaptureRecord, []byte, error) {
+	record := CaptureRecord{}
+	err := json.Unmarshal([]byte(line), &record)
+	if err != nil {
+		return record, nil, err
+	}
+	payload := []byte(record.Payload)
+	if strings.HasPrefix(string(payload), `"`) {
+		text := ""
+		if json.Unmarshal(payload, &text) == nil {
+			payload = []byte(text)
+		}
+	}
+	return record, payload, nil
+}
+
+// CaptureMqttClient record the messages published and received through a
+// client
+type CaptureMqttClient struct {
+	MqttClient
+	Capture *Capture
+	In      string
+	Out     string
+}
+
+func (self *CaptureMqttClient) Publish(topic string, payload []byte, qos uint8, retain bool) error {
+	self.Capture.RecordPublish(self.Out, topic, payload, qos, retain)
+	return self.MqttClient.Publish(topic, payload, qos, retain)
+}
+
+func (self *CaptureMqttClient) Subscribe(topic string, fnc SubscribeHandleFunction) error {
+	return self.MqttClient.Subscribe(topic, func(topic string, payload []byte) {
+		self.Capture.Record(self.In, topic, payload)
+		fnc(topic, payload)
+	})
+}
+
+// ConfigureCaptureSwitch add the switch enabling the debug capture of the
+// robot at runtime
+func (self *HomeAssistant) ConfigureCaptureSwitch(device_id string, dev *Device, capture *Capture) *Switch {
+	return_value := self.ConfigureSwitch(device_id, "debug_capture", dev, "mdi:record-rec")
+	return_value.Config.Name = "Debug capture"
+	return_value.State = SwitchState(capture.IsEnabled())
+	return_value.OnCommand = func(topic string, payload []byte) {
+		return_value.State = SwitchState(string(payload) == return_value.Config.PayloadOn)
+		capture.SetEnabled(bool(return_value.State))
+		return_value.NeedSendState = true
+		return_value.SendState()
+	}
+	return return_value
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestCaptureFiles check that the capture follows the robot id, rotates and
+// that the debug handler serves every capture file and nothing else
+func TestCaptureFiles(t *testing.T) {
+	folder := t.TempDir()
+	max_size, max_files := CAPTURE_MAX_SIZE, CAPTURE_MAX_FILES
+	CAPTURE_MAX_SIZE, CAPTURE_MAX_FILES = 200, 2
+	t.Cleanup(func() {
+		CAPTURE_MAX_SIZE, CAPTURE_MAX_FILES = max_size, max_files
+	})
+
+	capture := NewCapture(folder, "user")
+	if !capture.IsEnabled() {
+		t.Fatal("capture disabled with an existing debug folder")
+	}
+	capture.Record(capture_robot_in, "$aws/things/"+test_blid+"/shadow/update", []byte(`{"state":{}}`))
+	capture.SetRobotId(test_blid)
+	if _, err := os.Stat(path.Join(folder, "user.jsonl")); !os.IsNotExist(err) {
+		t.Errorf("capture of the user not moved: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		capture.RecordPublish(capture_master_out, "roomba2mqtt/vacuum/state", []byte(`{"state":"docked","battery_level":100}`), 0, true)
+	}
+	capture.SetEnabled(false)
+
+	files := capture.Files()
+	want := []string{test_blid + ".jsonl", test_blid + ".jsonl.1", test_blid + ".jsonl.2"}
+	if !reflect.DeepEqual(files, want) {
+		t.Fatalf("capture files %v, want %v", files, want)
+	}
+
+	vacuum_client_list = []*Client{{RoombaId: test_blid, Capture: capture}}
+	t.Cleanup(func() { vacuum_client_list = nil })
+	tests := map[string]string{
+		"/debug/" + test_blid:                       files[0],
+		"/debug/" + test_blid + "/" + files[2]:      files[2],
+		"/debug/" + test_blid + "/../retained.json": "",
+		"/debug/" + test_blid + "/user.jsonl":       "",
+		"/debug/unknown":                            "",
+	}
+	for url, file := range tests {
+		recorder := httptest.NewRecorder()
+		DebugHandler(recorder, httptest.NewRequest(http.MethodGet, url, nil))
+		if file == "" {
+			if recorder.Code != http.StatusNotFound {
+				t.Errorf("%s: status %d, want 404", url, recorder.Code)
+			}
+			continue
+		}
+		data, _ := ioutil.ReadFile(path.Join(folder, file))
+		if recorder.Code != http.StatusOK || recorder.Body.String() != string(data) {
+			t.Errorf("%s: status %d, want the content of %s", url, recorder.Code, file)
+		}
+	}
+}
+
+// TestCaptureFlags check that the qos and retain flags are only recorded for
+// the published messages
+func TestCaptureFlags(t *testing.T) {
+	capture := NewCapture(t.TempDir(), test_blid)
+	capture.Record(capture_robot_in, "wifistat", []byte(`{}`))
+	capture.RecordPublish(capture_master_out, "roomba2mqtt/vacuum/state", []byte(`{}`), 1, true)
+	capture.SetEnabled(false)
+
+	data, err := ioutil.ReadFile(capture.FileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d records, want 2", len(lines))
+	}
+	if strings.Contains(lines[0], "qos") || strings.Contains(lines[0], "retain") {
+		t.Errorf("received message recorded with flags: %s", lines[0])
+	}
+	record, _, err := ParseCaptureRecord(lines[1])
+	if err != nil || record.Qos == nil || *record.Qos != 1 || record.Retain == nil || !*record.Retain {
+		t.Errorf("published message recorded as %s", lines[1])
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// How long a step wait for the robot to report the expected phase
+var COMMAND_STEP_TIMEOUT = 30 * time.Second
+
+// How long the robot may take to reach its dock and start charging
+var COMMAND_DOCK_TIMEOUT = 10 * time.Minute
+
+// Initiator of the commands sent by the bridge, the robot reports it in the
+// cleanMissionStatus of the mission. The default is the value of the iRobot
+// app on the local connection as the firmware is only known to accept the
+// initiators of iRobot (localApp, rmtApp, schedule, ...). The missions started
+// by the bridge are told apart by the command that started them and shown
+// with bridge_initiator in the vacuum attributes and the mission maps.
+var COMMAND_INITIATOR = "localApp"
+
+// Initiator shown for the missions started by the bridge
+const bridge_initiator = "roomba2mqtt"
+
+// Errors of the commands that are not caused by the request, the API answer
+// them with 504 and 503
+var ErrRobotTimeout = errors.New("robot timeout")
+var ErrRobotDisconnected = errors.New("robot is not connected")
+
+// Phases reported while the robot goes back to or sits on the dock
+var dock_phases = []string{"hmUsrDock", "hmPostMsn", "charge", "evac"}
+
+// SequenceStep is a robot command and the cleanMissionStatus phases
+// confirming it, the next step is sent once one of them is reported. A step
+// without command only wait for the phases, Timeout default to
+// COMMAND_STEP_TIMEOUT.
+type SequenceStep struct {
+	Command Command
+	Phases  []string
+	Timeout time.Duration
+}
+
+// CommandResult is published on the result topic of the vacuum after each
+// command
+type CommandResult struct {
+	Command  string   `json:"command"`
+	Success  bool     `json:"success"`
+	Error    string   `json:"error,omitempty"`
+	Steps    []string `json:"steps"`
+	Duration float64  `json:"duration"`
+}
+
+func containsString(values []string, value string) bool {
+	for i := range values {
+		if values[i] == value {
+			return true
+		}
+	}
+	return false
+}
+
+// CommandSequence return the steps of a vacuum command for the current state
+// of the robot
+func CommandSequence(command_requested string, phase string, pmap_id string, regions []RoombaRegion) ([]SequenceStep, error) {
+	step := func(command string, phases ...string) SequenceStep {
+		return SequenceStep{
+			Command: Command{Command: command},
+			Phases:  phases,
+		}
+	}
+	cleaning := phase == "run"
+	on_dock := phase == "charge" || phase == "evac"
+
+	switch command_requested {
+	case "start":
+		if phase == "pause" {
+			return []SequenceStep{step("resume", "run")}, nil
+		}
+		return []SequenceStep{step("start", "run")}, nil
+	case "stop":
+		// the robot does not report stop on its dock, nothing to do
+		if on_dock {
+			return []SequenceStep{}, nil
+		}
+		return []SequenceStep{step("stop", "stop")}, nil
+	case "pause":
+		if on_dock {
+			return []SequenceStep{}, nil
+		}
+		return []SequenceStep{step("pause", "pause")}, nil
+	case "return_to_base", "dock":
+		steps := []SequenceStep{}
+		if cleaning {
+			steps = append(steps, step("stop", "stop"))
+		}
+		return append(steps, step("dock", dock_phases...)), nil
+	case "evacuate", "evac":
+		steps := []SequenceStep{}
+		if cleaning {
+			steps = append(steps, step("stop", "stop"))
+		}
+		if !containsString(dock_phases, phase) {
+			steps = append(steps, step("dock", dock_phases...))
+		}
+		// the robot confirms the dock command when it heads back, it can
+		// only empty its bin once charging
+		if !on_dock {
+			wait := step("", "charge")
+			wait.Timeout = COMMAND_DOCK_TIMEOUT
+			steps = append(steps, wait)
+		}
+		return append(steps, step("evac", "evac")), nil
+	case "locate", "find":
+		// the robot plays a sound without changing phase
+		return []SequenceStep{step("find")}, nil
+	case "train":
+		return []SequenceStep{step("train", "run")}, nil
+	case "clean_spot", "rooms":
+		// clean_spot is the deprecated name of rooms, without regions it
+		// starts a full clean as it always did
+		if command_requested == "rooms" && len(regions) == 0 {
+			return nil, errors.New("no region selected")
+		}
+		start := step("start", "run")
+		start.Command.PmapId = pmap_id
+		start.Command.Regions = regions
+		return []SequenceStep{start}, nil
+	}
+	return nil, fmt.Errorf("unknown command %s", command_requested)
+}
+
+// RunSequence send the steps one after the other, waiting for the robot to
+// confirm each of them. It runs on the command goroutine of the loop.
+func (self *Vacuum) RunSequence(steps []SequenceStep) error {
+	for i := range steps {
+		if steps[i].Command.Command != "" {
+			err := self.sendCommand(steps[i].Command)
+			if err != nil {
+				return err
+			}
+		}
+		if len(steps[i].Phases) == 0 {
+			continue
+		}
+		phases := steps[i].Phases
+		timeout := steps[i].Timeout
+		if timeout == 0 {
+			timeout = COMMAND_STEP_TIMEOUT
+		}
+		confirmed := self.HomeAssistant.Loop.WaitFor(func() bool {
+			return containsString(phases, self.Phase)
+		}, timeout)
+		if !confirmed && steps[i].Command.Command == "" {
+			return fmt.Errorf("%w: robot not in phase %s after %s", ErrRobotTimeout, strings.Join(phases, " or "), timeout)
+		}
+		if !confirmed {
+			return fmt.Errorf("%w: %s not confirmed by the robot after %s, expected phase %s",
+				ErrRobotTimeout, steps[i].Command.Command, timeout, strings.Join(phases, " or "))
+		}
+	}
+	return nil
+}
+
+// SendResult publish the result of a command, from the loop
+func (self *Vacuum) SendResult(result CommandResult) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		log.Error().Err(err).Msg("Command result")
+		return
+	}
+	err = self.HomeAssistant.MasterMqttClient.Publish(self.ResultTopic, data, global_qos_value, false)
+	if err != nil {
+		log.Warn().Err(err).Str("topic", self.ResultTopic).Msg("Command result")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCommandSequence(t *testing.T) {
+	tests := []struct {
+		command string
+		phase   string
+		steps   []string
+	}{
+		{"start", "charge", []string{"start"}},
+		{"start", "pause", []string{"resume"}},
+		{"stop", "run", []string{"stop"}},
+		{"stop", "charge", []string{}},
+		{"pause", "charge", []string{}},
+		{"pause", "evac", []string{}},
+		{"pause", "run", []string{"pause"}},
+		{"dock", "run", []string{"stop", "dock"}},
+		{"evacuate", "run", []string{"stop", "dock", "", "evac"}},
+		{"evacuate", "stop", []string{"dock", "", "evac"}},
+		{"evacuate", "hmUsrDock", []string{"", "evac"}},
+		{"evacuate", "hmPostMsn", []string{"", "evac"}},
+		{"evacuate", "charge", []string{"evac"}},
+	}
+	for i := range tests {
+		steps, err := CommandSequence(tests[i].command, tests[i].phase, "", nil)
+		if err != nil {
+			t.Errorf("%s in %s: %s", tests[i].command, tests[i].phase, err)
+			continue
+		}
+		commands := []string{}
+		for j := range steps {
+			commands = append(commands, steps[j].Command.Command)
+		}
+		if !reflect.DeepEqual(commands, tests[i].steps) {
+			t.Errorf("%s in %s: steps %q, want %q", tests[i].command, tests[i].phase, commands, tests[i].steps)
+		}
+	}
+
+	// the wait for the dock accepts the time the robot takes to come back
+	steps, _ := CommandSequence("evacuate", "run", "", nil)
+	if steps[2].Timeout != COMMAND_DOCK_TIMEOUT || !reflect.DeepEqual(steps[2].Phases, []string{"charge"}) {
+		t.Errorf("dock wait step %+v", steps[2])
+	}
+	if steps[1].Timeout != 0 || !reflect.DeepEqual(steps[1].Phases, dock_phases) {
+		t.Errorf("dock step %+v", steps[1])
+	}
+
+	if _, err := CommandSequence("rooms", "charge", "", nil); err == nil {
+		t.Error("rooms without region accepted")
+	}
+	if _, err := CommandSequence("fly", "charge", "", nil); err == nil {
+		t.Error("unknown command accepted")
+	}
+}
+
+// TestStopOnDock check that stop and pause succeed at once on a docked robot
+func TestStopOnDock(t *testing.T) {
+	_, config := startSimulatedRobot(t)
+	master := NewFakeMqttClient()
+	master.Connect()
+	client := startBridge(t, config, master)
+
+	for _, command := range []string{"stop", "pause"} {
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := WaitCommand(ctx, client.Loop.Queue(RobotCommand{Command: command}))
+		cancel()
+		if err != nil {
+			t.Errorf("%s: %s", command, err)
+		}
+		if time.Since(start) > time.Second {
+			t.Errorf("%s took %s", command, time.Since(start))
+		}
+	}
+}
+
+// TestEvacuateWhileCleaning check that evacuate docks the robot, waits for
+// the charge and empties the bin. The robot takes longer than a step to
+// reach its dock.
+func TestEvacuateWhileCleaning(t *testing.T) {
+	step_timeout := COMMAND_STEP_TIMEOUT
+	COMMAND_STEP_TIMEOUT = 300 * time.Millisecond
+	t.Cleanup(func() { COMMAND_STEP_TIMEOUT = step_timeout })
+
+	robot, config := startSimulatedRobot(t)
+	master := NewFakeMqttClient()
+	master.Connect()
+	client := startBridge(t, config, master)
+
+	done := make(chan bool)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	t.Cleanup(func() {
+		close(done)
+		ticker.Stop()
+	})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				robot.Tick()
+			}
+		}
+	}()
+
+	for _, command := range []string{"start", "evacuate"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := WaitCommand(ctx, client.Loop.Queue(RobotCommand{Command: command}))
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: %s", command, err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+type FakeMqttMessage struct {
+	Topic   string
+	Payload []byte
+	Qos     uint8
+	Retain  bool
+}
+
+// FakeMqttClient is an in memory MqttClient. Published messages are recorded
+// and delivered to the matching subscriptions like a broker would, Deliver
+// inject messages and Drop simulate a lost connection.
+type FakeMqttClient struct {
+	Published []FakeMqttMessage
+	Retained  map[string][]byte
+	// PublishError is returned by Publish when set
+	PublishError       error
+	router             TopicRouter
+	connected          bool
+	on_connection_up   func()
+	on_connection_lost func(err error)
+	mutex              sync.Mutex
+}
+
+func NewFakeMqttClient() *FakeMqttClient {
+	return &FakeMqttClient{
+		Retained: map[string][]byte{},
+	}
+}
+
+func (self *FakeMqttClient) Connect() error {
+	self.mutex.Lock()
+	self.connected = true
+	on_connection_up := self.on_connection_up
+	self.mutex.Unlock()
+
+	if on_connection_up != nil {
+		on_connection_up()
+	}
+	return nil
+}
+
+func (self *FakeMqttClient) Disconnect(ctx context.Context) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.connected = false
+	return nil
+}
+
+// Drop close the connection as if the broker went away
+func (self *FakeMqttClient) Drop(err error) {
+	self.mutex.Lock()
+	self.connected = false
+	on_connection_lost := self.on_connection_lost
+	self.mutex.Unlock()
+
+	if on_connection_lost != nil {
+		on_connection_lost(err)
+	}
+}
+
+func (self *FakeMqttClient) IsConnected() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.connected
+}
+
+func (self *FakeMqttClient) Publish(topic string, payload []byte, qos uint8, retain bool) error {
+	self.mutex.Lock()
+	if !self.connected {
+		self.mutex.Unlock()
+		return errors.New("not connected")
+	}
+	if self.PublishError != nil {
+		err := self.PublishError
+		self.mutex.Unlock()
+		return err
+	}
+	self.Published = append(self.Published, FakeMqttMessage{
+		Topic:   topic,
+		Payload: payload,
+		Qos:     qos,
+		Retain:  retain,
+	})
+	if retain {
+		if len(payload) == 0 {
+			delete(self.Retained, topic)
+		} else {
+			self.Retained[topic] = payload
+		}
+	}
+	self.mutex.Unlock()
+
+	self.router.Route(topic, payload)
+	return nil
+}
+
+// Deliver send a message to the subscriptions, as if received from the broker
+func (self *FakeMqttClient) Deliver(topic string, payload []byte) bool {
+	return self.router.Route(topic, payload)
+}
+
+// Subscribe also deliver the matching retained messages, like a broker
+func (self *FakeMqttClient) Subscribe(topic string, fnc SubscribeHandleFunction) error {
+	self.router.Add(topic, fnc)
+
+	self.mutex.Lock()
+	retained := map[string][]byte{}
+	for retained_topic, payload := range self.Retained {
+		if TopicMatch(topic, retained_topic) {
+			retained[retained_topic] = payload
+		}
+	}
+	self.mutex.Unlock()
+
+	for retained_topic, payload := range retained {
+		fnc(retained_topic, payload)
+	}
+	return nil
+}
+
+func (self *FakeMqttClient) Unsubscribe(topic string) error {
+	self.router.Remove(topic)
+	return nil
+}
+
+func (self *FakeMqttClient) OnConnectionUp(fnc func()) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.on_connection_up = fnc
+}
+
+func (self *FakeMqttClient) OnConnectionLost(fnc func(err error)) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.on_connection_lost = fnc
+}
+
+// Messages return a copy of the published messages
+func (self *FakeMqttClient) Messages() []FakeMqttMessage {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return append([]FakeMqttMessage{}, self.Published...)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Time a robot can stay disconnected, retrying in backoff, before the bridge
+// is reported as not ready
+var READY_ROBOT_TOLERANCE = 5 * time.Minute
+
+var master_connected int32
+
+func SetMasterConnected(connected bool) {
+	if connected {
+		atomic.StoreInt32(&master_connected, 1)
+	} else {
+		atomic.StoreInt32(&master_connected, 0)
+	}
+}
+
+func IsMasterConnected() bool {
+	return atomic.LoadInt32(&master_connected) == 1
+}
+
+func (self *Client) SetConnected(connected bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.Connected = connected
+	if connected {
+		self.DisconnectedSince = time.Time{}
+	} else if self.DisconnectedSince.IsZero() {
+		self.DisconnectedSince = time.Now()
+	}
+}
+
+func (self *Client) IsConnected() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.Connected
+}
+
+// IsReady is true when the robot is connected or has been trying to
+// reconnect for less than READY_ROBOT_TOLERANCE
+func (self *Client) IsReady() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.Connected || time.Since(self.DisconnectedSince) < READY_ROBOT_TOLERANCE
+}
+
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	problems := []string{}
+	if !IsMasterConnected() {
+		problems = append(problems, "master broker not connected")
+	}
+	for i := range vacuum_client_list {
+		if !vacuum_client_list[i].IsReady() {
+			problems = append(problems, fmt.Sprintf("robot %s not connected", vacuum_client_list[i].LockedId()))
+		}
+	}
+
+	if len(problems) > 0 {
+		http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// Healthcheck query the health endpoint of a running bridge, used as Docker
+// HEALTHCHECK so curl is not needed in the image. Return the process exit code.
+// With an empty HTTP_ADDRESS the web server is disabled and there is nothing
+// to query, the check passes so the container is not marked unhealthy.
+func Healthcheck(address string, endpoint string) int {
+	if address == "" {
+		fmt.Fprintln(os.Stderr, "HTTP server disabled, health not checked")
+		return 0
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+
+	client := http.Client{Timeout: 5 * time.Second}
+	res, err := client.Get(fmt.Sprintf("http://%s/%s", net.JoinHostPort(host, port), endpoint))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, res.Status)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestHealthcheck check the exit code of the healthcheck command, a disabled
+// web server is not a failure
+func TestHealthcheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(HealthzHandler))
+	t.Cleanup(server.Close)
+
+	tests := map[string]int{
+		"":     0,
+		"8080": 1,
+		strings.TrimPrefix(server.URL, "http://"): 0,
+	}
+	for address, code := range tests {
+		if got := Healthcheck(address, "healthz"); got != code {
+			t.Errorf("Healthcheck(%q) = %d, want %d", address, got, code)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"path"
+	"regexp"
 	"strings"
 	"time"
 
@@ -12,6 +13,10 @@ import (
 
 type Entity struct {
 	ConfigTopic        string
+	Component          string
+	DeviceId           string
+	ObjectId           string
+	OnCommand          SubscribeHandleFunction
 	Attributes         map[string]interface{}
 	HomeAssistant      *HomeAssistant
 	NeedSendState      bool
@@ -34,6 +39,7 @@ type VacuumConfig struct {
 	SupportedFeatures   []string `json:"supported_features"`
 	AvailabilityTopic   string   `json:"availability_topic"`
 	CommandTopic        string   `json:"command_topic"`
+	SendCommandTopic    string   `json:"send_command_topic"`
 	StateTopic          string   `json:"state_topic"`
 	JsonAttributesTopic string   `json:"json_attributes_topic"`
 	ErrorTopic          string   `json:"error_topic"`
@@ -51,6 +57,12 @@ type Vacuum struct {
 	Entity
 	Config VacuumConfig
 	State  VacuumState
+	// Phase is the last cleanMissionStatus phase reported by the robot
+	Phase       string
+	ResultTopic string
+	// command_time is when the bridge last sent a command starting a mission
+	command_time      time.Time
+	mission_initiator string
 }
 
 type SwitchConfig struct {
@@ -75,7 +87,7 @@ type Switch struct {
 }
 
 type RoombaRegionSwitch struct {
-	Switch
+	*Switch
 	Region *Region
 	Map    *Map
 }
@@ -104,33 +116,436 @@ type CleanPassSelect struct {
 	Select
 }
 
+type CameraConfig struct {
+	Name                string  `json:"name"`
+	Topic               string  `json:"topic"`
+	AvailabilityTopic   string  `json:"availability_topic"`
+	JsonAttributesTopic string  `json:"json_attributes_topic"`
+	UniqueId            string  `json:"unique_id"`
+	Device              *Device `json:"device"`
+	Icon                string  `json:"icon"`
+}
+
+type CameraState []byte
+
+type Camera struct {
+	Entity
+	Config CameraConfig
+	State  CameraState
+}
+
+type TriggerConfig struct {
+	AutomationType string  `json:"automation_type"`
+	Topic          string  `json:"topic"`
+	Type           string  `json:"type"`
+	Subtype        string  `json:"subtype"`
+	Payload        string  `json:"payload"`
+	Device         *Device `json:"device"`
+}
+
+type ButtonConfig struct {
+	Name              string  `json:"name"`
+	CommandTopic      string  `json:"command_topic"`
+	PayloadPress      string  `json:"payload_press"`
+	AvailabilityTopic string  `json:"availability_topic"`
+	UniqueId          string  `json:"unique_id"`
+	Device            *Device `json:"device"`
+	Icon              string  `json:"icon"`
+}
+
+// Button run a vacuum command sequence when pressed
+type Button struct {
+	Entity
+	Config  ButtonConfig
+	Command string
+}
+
+// Trigger is a device trigger, it has no state and fire events on its topic
+type Trigger struct {
+	Entity
+	Config TriggerConfig
+}
+
 type HomeAssistant struct {
 	MqttClient       MqttClient
 	MasterMqttClient MqttClient
 	ConfigBaseTopic  string
 	CommandBaseTopic string
+	TopicTemplate    string
+	RobotId          string
+	RobotName        string
 	Entities         []interface{}
 	Vacuum           *Vacuum
 	RegionSwitches   []*RoombaRegionSwitch
 	CleanPassSelect  *CleanPassSelect
+	MissionCamera    *Camera
+	CaptureSwitch    *Switch
+	Triggers         map[string]*Trigger
+	Buttons          map[string]*Button
+	// CommandHandlers are the command topics that are not entities
+	CommandHandlers map[string]SubscribeHandleFunction
+	// Loop run the command handlers, nil run them on the MQTT goroutine
+	Loop             *RobotLoop
+	subscribed       map[string]bool
+	raw_command_base string
+}
+
+// publish send a retained message of the entity on the master broker, on
+// error the caller return without clearing its NeedSend flag so the message
+// is sent again on the next update
+func (self *Entity) publish(topic string, payload []byte) bool {
+	err := self.HomeAssistant.MasterMqttClient.Publish(topic, payload, global_qos_value, global_retain_value)
+	if err != nil {
+		log.Warn().Err(err).Str("topic", topic).Msg("MQTT publish")
+		return false
+	}
+	return true
+}
+
+// MarkDirty force the entity to be sent again on next update
+func (self *Entity) MarkDirty() {
+	self.NeedSendConfig = true
+	self.NeedSendState = true
+	self.NeedSendAttributes = true
+}
+
+// Layout of the per robot topics, the variables are
+//
+//	{base}       MQTT_BASE_TOPIC
+//	{component}  Home Assistant component (vacuum, switch, ...)
+//	{blid}       robot blid
+//	{name}       slugified robot name, blid until the robot reports it
+//	{object}     entity id within the robot (vacuum, clean_pass, ...)
+//	{entity}     <blid>_<object>, <blid> for the vacuum
+var MQTT_TOPIC_TEMPLATE = "{base}/{component}/homeassistant/{entity}"
+
+var slug_regexp = regexp.MustCompile("[^a-z0-9]+")
+
+func Slugify(value string) string {
+	return strings.Trim(slug_regexp.ReplaceAllString(strings.ToLower(value), "_"), "_")
+}
+
+// EntityId is the id of the entity within Home Assistant component
+func (self *Entity) EntityId() string {
+	if self.ObjectId == "" {
+		return self.DeviceId
+	}
+	return self.DeviceId + "_" + self.ObjectId
+}
+
+// UniqueId keep the ids of the first versions so Home Assistant entities are
+// not duplicated
+func (self *Entity) UniqueId() string {
+	switch self.Component {
+	case "vacuum":
+		return "roomba_" + self.DeviceId
+	case "select":
+		return "roomba_switch_" + self.EntityId()
+	}
+	return "roomba_" + self.Component + "_" + self.EntityId()
+}
+
+func (self *HomeAssistant) DiscoveryTopic(entity *Entity) string {
+	return path.Join(self.ConfigBaseTopic, entity.Component, entity.EntityId(), entity.Component, "config")
+}
+
+// EntityTopic return the base topic of an entity according to the topic
+// template
+func (self *HomeAssistant) EntityTopic(entity *Entity) string {
+	object := entity.ObjectId
+	if object == "" {
+		object = entity.Component
+	}
+	name := Slugify(self.RobotName)
+	if name == "" {
+		name = entity.DeviceId
+	}
+
+	return strings.NewReplacer(
+		"{base}", self.CommandBaseTopic,
+		"{component}", entity.Component,
+		"{blid}", entity.DeviceId,
+		"{name}", name,
+		"{object}", object,
+		"{entity}", entity.EntityId(),
+	).Replace(self.TopicTemplate)
+}
+
+func (self *Vacuum) SetBaseTopic(base string) {
+	self.Config.AvailabilityTopic = path.Join(base, "available")
+	self.Config.StateTopic = path.Join(base, "state")
+	self.Config.CommandTopic = path.Join(base, "command")
+	// vacuum.send_command publish the command name, e.g. evacuate
+	self.Config.SendCommandTopic = self.Config.CommandTopic
+	self.Config.JsonAttributesTopic = path.Join(base, "attributes")
+	self.Config.ErrorTopic = path.Join(base, "state")
+	self.ResultTopic = path.Join(base, "result")
+}
+
+func (self *Switch) SetBaseTopic(base string) {
+	self.Config.CommandTopic = path.Join(base, "command")
+	self.Config.AvailabilityTopic = path.Join(base, "available")
+	self.Config.JsonAttributesTopic = path.Join(base, "attributes")
+	self.Config.StateTopic = path.Join(base, "state")
+}
+
+func (self *Select) SetBaseTopic(base string) {
+	self.Config.CommandTopic = path.Join(base, "command")
+	self.Config.AvailabilityTopic = path.Join(base, "available")
+	self.Config.JsonAttributesTopic = path.Join(base, "attributes")
+	self.Config.StateTopic = path.Join(base, "state")
+}
+
+func (self *Camera) SetBaseTopic(base string) {
+	self.Config.Topic = path.Join(base, "image")
+	self.Config.AvailabilityTopic = path.Join(base, "available")
+	self.Config.JsonAttributesTopic = path.Join(base, "attributes")
+}
+
+func (self *Button) SetBaseTopic(base string) {
+	self.Config.CommandTopic = path.Join(base, "command")
+	self.Config.AvailabilityTopic = path.Join(base, "available")
+}
+
+// SetBaseTopic move the event topic, the events are not queued while the
+// master broker is unreachable
+func (self *Trigger) SetBaseTopic(base string) {
+	master_mqtt_queue.SetUnqueued(self.Config.Topic, false)
+	self.Config.Topic = path.Join(base, "event")
+	master_mqtt_queue.SetUnqueued(self.Config.Topic, true)
+}
+
+// SetRobotName move the entities topics when the layout depends on the robot
+// name
+func (self *HomeAssistant) SetRobotName(name string) {
+	if self.RobotName == name {
+		return
+	}
+	self.RobotName = name
+	if strings.Contains(RAW_COMMAND_TOPIC, "{name}") {
+		self.ConfigureRawCommands()
+		self.SubscribeCommands()
+	}
+	if !strings.Contains(self.TopicTemplate, "{name}") {
+		return
+	}
+
+	for i := range self.Entities {
+		switch entity := self.Entities[i].(type) {
+		case *Vacuum:
+			entity.SetBaseTopic(self.EntityTopic(&entity.Entity))
+		case *Switch:
+			entity.SetBaseTopic(self.EntityTopic(&entity.Entity))
+		case *Select:
+			entity.SetBaseTopic(self.EntityTopic(&entity.Entity))
+		case *Camera:
+			entity.SetBaseTopic(self.EntityTopic(&entity.Entity))
+		case *Button:
+			entity.SetBaseTopic(self.EntityTopic(&entity.Entity))
+		case *Trigger:
+			entity.SetBaseTopic(self.EntityTopic(&entity.Entity))
+		}
+	}
+	self.SubscribeCommands()
+	self.Republish()
+}
+
+// EntityRetainedTopics return the topics an entity publish retained messages on
+func EntityRetainedTopics(entity interface{}) []string {
+	switch e := entity.(type) {
+	case *Vacuum:
+		return []string{e.ConfigTopic, e.Config.StateTopic, e.Config.AvailabilityTopic, e.Config.JsonAttributesTopic}
+	case *Switch:
+		return []string{e.ConfigTopic, e.Config.StateTopic, e.Config.AvailabilityTopic, e.Config.JsonAttributesTopic}
+	case *Select:
+		return []string{e.ConfigTopic, e.Config.StateTopic, e.Config.AvailabilityTopic, e.Config.JsonAttributesTopic}
+	case *Camera:
+		return []string{e.ConfigTopic, e.Config.Topic, e.Config.AvailabilityTopic, e.Config.JsonAttributesTopic}
+	case *Button:
+		return []string{e.ConfigTopic, e.Config.AvailabilityTopic}
+	case *Trigger:
+		return []string{e.ConfigTopic}
+	}
+	return []string{}
+}
+
+// RetainedTopics return the topics of every live entity
+func (self *HomeAssistant) RetainedTopics() []string {
+	return_value := []string{}
+	for i := range self.Entities {
+		return_value = append(return_value, EntityRetainedTopics(self.Entities[i])...)
+	}
+	return return_value
+}
+
+// RemoveRegionSwitch forget a region switch, its retained messages are
+// cleared by the next cleanup
+func (self *HomeAssistant) RemoveRegionSwitch(region_switch *RoombaRegionSwitch) {
+	for i := range self.RegionSwitches {
+		if self.RegionSwitches[i] == region_switch {
+			self.RegionSwitches = append(self.RegionSwitches[:i], self.RegionSwitches[i+1:]...)
+			break
+		}
+	}
+	for i := range self.Entities {
+		if self.Entities[i] == region_switch.Switch {
+			self.Entities = append(self.Entities[:i], self.Entities[i+1:]...)
+			break
+		}
+	}
+	self.SubscribeCommands()
+}
+
+// SetRobotId key every entity with the robot blid. The entities are created
+// before the robot reports its blid, if they were created with another id
+// the retained messages published under that id by previous versions are
+// removed.
+func (self *HomeAssistant) SetRobotId(robot_id string) {
+	self.RobotId = robot_id
+
+	old_topics := []string{}
+	for i := range self.Entities {
+		var entity *Entity
+		switch e := self.Entities[i].(type) {
+		case *Vacuum:
+			entity = &e.Entity
+			if e.DeviceId != robot_id {
+				old_topics = append(old_topics, EntityRetainedTopics(e)...)
+				e.DeviceId = robot_id
+				e.Config.UniqueId = e.UniqueId()
+				e.SetBaseTopic(self.EntityTopic(entity))
+			}
+			e.Config.Device.Identifiers = []string{robot_id}
+		case *Switch:
+			entity = &e.Entity
+			if e.DeviceId != robot_id {
+				old_topics = append(old_topics, EntityRetainedTopics(e)...)
+				e.DeviceId = robot_id
+				e.Config.UniqueId = e.UniqueId()
+				e.SetBaseTopic(self.EntityTopic(entity))
+			}
+		case *Select:
+			entity = &e.Entity
+			if e.DeviceId != robot_id {
+				old_topics = append(old_topics, EntityRetainedTopics(e)...)
+				e.DeviceId = robot_id
+				e.Config.UniqueId = e.UniqueId()
+				e.SetBaseTopic(self.EntityTopic(entity))
+			}
+		case *Camera:
+			entity = &e.Entity
+			if e.DeviceId != robot_id {
+				old_topics = append(old_topics, EntityRetainedTopics(e)...)
+				e.DeviceId = robot_id
+				e.Config.UniqueId = e.UniqueId()
+				e.SetBaseTopic(self.EntityTopic(entity))
+			}
+		case *Button:
+			entity = &e.Entity
+			if e.DeviceId != robot_id {
+				old_topics = append(old_topics, EntityRetainedTopics(e)...)
+				e.DeviceId = robot_id
+				e.Config.UniqueId = e.UniqueId()
+				e.SetBaseTopic(self.EntityTopic(entity))
+			}
+		case *Trigger:
+			entity = &e.Entity
+			if e.DeviceId != robot_id {
+				old_topics = append(old_topics, EntityRetainedTopics(e)...)
+				e.DeviceId = robot_id
+				e.SetBaseTopic(self.EntityTopic(entity))
+			}
+		}
+		if entity != nil {
+			entity.ConfigTopic = self.DiscoveryTopic(entity)
+		}
+	}
+
+	for i := range old_topics {
+		log.Info().Str("topic", old_topics[i]).Msg("Removing retained message of previous id")
+		err := self.MasterMqttClient.Publish(old_topics[i], []byte{}, global_qos_value, true)
+		if err != nil {
+			log.Warn().Err(err).Str("topic", old_topics[i]).Msg("Removing retained message of previous id")
+		}
+	}
+	self.ConfigureRawCommands()
+	self.SubscribeCommands()
+	self.Republish()
+}
+
+// SubscribeCommands subscribe the command topic of every entity accepting
+// commands and unsubscribe the topics no entity use anymore
+func (self *HomeAssistant) SubscribeCommands() {
+	live := map[string]bool{}
+	for i := range self.Entities {
+		command_topic := ""
+		var on_command SubscribeHandleFunction
+		switch entity := self.Entities[i].(type) {
+		case *Vacuum:
+			command_topic, on_command = entity.Config.CommandTopic, entity.OnCommand
+		case *Switch:
+			command_topic, on_command = entity.Config.CommandTopic, entity.OnCommand
+		case *Select:
+			command_topic, on_command = entity.Config.CommandTopic, entity.OnCommand
+		case *Button:
+			command_topic, on_command = entity.Config.CommandTopic, entity.OnCommand
+		}
+		if command_topic != "" && on_command != nil {
+			live[command_topic] = true
+			self.subscribe(command_topic, on_command)
+		}
+	}
+	for command_topic, on_command := range self.CommandHandlers {
+		live[command_topic] = true
+		self.subscribe(command_topic, on_command)
+	}
+	for topic := range self.subscribed {
+		if live[topic] {
+			continue
+		}
+		delete(self.subscribed, topic)
+		err := self.MasterMqttClient.Unsubscribe(topic)
+		if err != nil {
+			log.Error().Err(err).Str("topic", topic).Msg("MQTT unsubscribe")
+		}
+	}
+}
+
+// subscribe a command topic once, the client accept several handlers per
+// topic and the commands would be executed twice
+func (self *HomeAssistant) subscribe(topic string, fnc SubscribeHandleFunction) {
+	if self.subscribed == nil {
+		self.subscribed = map[string]bool{}
+	}
+	if self.subscribed[topic] {
+		return
+	}
+	// the handler is registered even on error, the client subscribe again on
+	// reconnection
+	self.subscribed[topic] = true
+	if self.Loop != nil {
+		fnc = self.Loop.Handler(fnc)
+	}
+	err := self.MasterMqttClient.Subscribe(topic, fnc)
+	if err != nil {
+		log.Error().Err(err).Str("topic", topic).Msg("MQTT subscribe")
+	}
 }
 
 var global_retain_value bool = true
 var global_qos_value uint8 = 0
 
 func (self *HomeAssistant) ConfigureVacuum(roomba_id string) *Vacuum {
-	base_vacuum_topic := path.Join(self.CommandBaseTopic, fmt.Sprintf("vacuum/homeassistant/%s/", roomba_id))
-
 	vacuum := &Vacuum{
 		Entity: Entity{
 			HomeAssistant: self,
-			ConfigTopic:   path.Join(self.ConfigBaseTopic, fmt.Sprintf("/vacuum/%s/vacuum/config", roomba_id)),
+			Component:     "vacuum",
+			DeviceId:      roomba_id,
 			Attributes:    make(map[string]interface{}),
 		},
 		Config: VacuumConfig{
-			Schema:   "state",
-			Name:     "temp_name",
-			UniqueId: "roomba_" + roomba_id,
+			Schema: "state",
+			Name:   "temp_name",
 
 			SupportedFeatures: []string{
 				"start",
@@ -140,15 +555,9 @@ func (self *HomeAssistant) ConfigureVacuum(roomba_id string) *Vacuum {
 				"battery",
 				"status",
 				//			"locate",
-				"clean_spot",
 				"send_command",
 			},
-			AvailabilityTopic:   path.Join(base_vacuum_topic, "available"),
-			StateTopic:          path.Join(base_vacuum_topic, "state"),
-			CommandTopic:        path.Join(base_vacuum_topic, "command"),
-			JsonAttributesTopic: path.Join(base_vacuum_topic, "attributes"),
-			ErrorTopic:          path.Join(base_vacuum_topic, "state"),
-			ErrorTemplate:       "{{ value_json.error }}",
+			ErrorTemplate: "{{ value_json.error }}",
 
 			Device: &Device{
 				Name: "temp_name",
@@ -163,6 +572,11 @@ func (self *HomeAssistant) ConfigureVacuum(roomba_id string) *Vacuum {
 		},
 	}
 
+	vacuum.OnCommand = vacuum.CommandHandler
+	vacuum.ConfigTopic = self.DiscoveryTopic(&vacuum.Entity)
+	vacuum.Config.UniqueId = vacuum.UniqueId()
+	vacuum.SetBaseTopic(self.EntityTopic(&vacuum.Entity))
+
 	self.Entities = append(self.Entities, vacuum)
 	self.Vacuum = vacuum
 
@@ -171,39 +585,37 @@ func (self *HomeAssistant) ConfigureVacuum(roomba_id string) *Vacuum {
 
 func (self *HomeAssistant) ConfigureRoombaRegionSwitch(roomba_id string, switch_id string, dev *Device, icon string) *RoombaRegionSwitch {
 	return_value := &RoombaRegionSwitch{
-		Switch: *self.ConfigureSwitch(roomba_id, switch_id, dev, icon),
+		Switch: self.ConfigureSwitch(roomba_id, switch_id, dev, icon),
 	}
 
 	self.RegionSwitches = append(self.RegionSwitches, return_value)
 
-	self.MasterMqttClient.Subscribe(return_value.Config.CommandTopic, return_value.CommandHandler)
+	return_value.OnCommand = return_value.CommandHandler
+	self.subscribe(return_value.Config.CommandTopic, return_value.CommandHandler)
 
 	return return_value
 }
 
 func (self *HomeAssistant) ConfigureSwitch(device_id string, switch_id string, dev *Device, icon string) *Switch {
-	base_switch_topic := path.Join(self.CommandBaseTopic, fmt.Sprintf("switch/homeassistant/%s_%s/", device_id, switch_id))
-	unique_id := "roomba_switch_" + device_id + "_" + switch_id
-
 	return_value := &Switch{
 		Entity: Entity{
 			HomeAssistant: self,
-			ConfigTopic:   path.Join(self.ConfigBaseTopic, fmt.Sprintf("/switch/%s_%s/switch/config", device_id, switch_id)),
+			Component:     "switch",
+			DeviceId:      device_id,
+			ObjectId:      switch_id,
 			Attributes:    make(map[string]interface{}),
 		},
 		Config: SwitchConfig{
-			Name:                "zone_" + switch_id,
-			UniqueId:            unique_id,
-			Device:              dev,
-			CommandTopic:        path.Join(base_switch_topic, "command"),
-			AvailabilityTopic:   path.Join(base_switch_topic, "available"),
-			JsonAttributesTopic: path.Join(base_switch_topic, "attributes"),
-			StateTopic:          path.Join(base_switch_topic, "state"),
-			PayloadOff:          "OFF",
-			PayloadOn:           "ON",
-			Icon:                icon,
+			Name:       "zone_" + switch_id,
+			Device:     dev,
+			PayloadOff: "OFF",
+			PayloadOn:  "ON",
+			Icon:       icon,
 		},
 	}
+	return_value.ConfigTopic = self.DiscoveryTopic(&return_value.Entity)
+	return_value.Config.UniqueId = return_value.UniqueId()
+	return_value.SetBaseTopic(self.EntityTopic(&return_value.Entity))
 
 	self.Entities = append(self.Entities, return_value)
 	return_value.NeedSendConfig = true
@@ -213,28 +625,25 @@ func (self *HomeAssistant) ConfigureSwitch(device_id string, switch_id string, d
 }
 
 func (self *HomeAssistant) ConfigureSelect(device_id string, select_id string, dev *Device, icon string, options []string) *Select {
-	base_switch_topic := path.Join(self.CommandBaseTopic, fmt.Sprintf("select/homeassistant/%s_%s/", device_id, select_id))
-	unique_id := "roomba_switch_" + device_id + "_" + select_id
-
 	return_value := &Select{
 		Entity: Entity{
 			HomeAssistant: self,
-			ConfigTopic:   path.Join(self.ConfigBaseTopic, fmt.Sprintf("/select/%s_%s/select/config", device_id, select_id)),
+			Component:     "select",
+			DeviceId:      device_id,
+			ObjectId:      select_id,
 			Attributes:    make(map[string]interface{}),
 		},
 		Config: SelectConfig{
-			Name:                select_id,
-			UniqueId:            unique_id,
-			Device:              dev,
-			CommandTopic:        path.Join(base_switch_topic, "command"),
-			AvailabilityTopic:   path.Join(base_switch_topic, "available"),
-			JsonAttributesTopic: path.Join(base_switch_topic, "attributes"),
-			StateTopic:          path.Join(base_switch_topic, "state"),
-			Options:             options,
-			Icon:                icon,
-			EntityCategory:      "config",
+			Name:           select_id,
+			Device:         dev,
+			Options:        options,
+			Icon:           icon,
+			EntityCategory: "config",
 		},
 	}
+	return_value.ConfigTopic = self.DiscoveryTopic(&return_value.Entity)
+	return_value.Config.UniqueId = return_value.UniqueId()
+	return_value.SetBaseTopic(self.EntityTopic(&return_value.Entity))
 
 	self.Entities = append(self.Entities, return_value)
 	return_value.NeedSendConfig = true
@@ -254,17 +663,64 @@ func (self *HomeAssistant) ConfigureCleanPassSelect(device_id string, select_id
 	return_value.NeedSendConfig = true
 	return_value.NeedSendState = true
 
-	self.MasterMqttClient.Subscribe(return_value.Config.CommandTopic, return_value.CommandHandler)
+	return_value.OnCommand = return_value.CommandHandler
+	self.subscribe(return_value.Config.CommandTopic, return_value.CommandHandler)
 
 	return return_value
 }
 
+func (self *HomeAssistant) ConfigureCamera(device_id string, camera_id string, dev *Device, icon string) *Camera {
+	return_value := &Camera{
+		Entity: Entity{
+			HomeAssistant: self,
+			Component:     "camera",
+			DeviceId:      device_id,
+			ObjectId:      camera_id,
+			Attributes:    make(map[string]interface{}),
+		},
+		Config: CameraConfig{
+			Name:   camera_id,
+			Device: dev,
+			Icon:   icon,
+		},
+	}
+	return_value.ConfigTopic = self.DiscoveryTopic(&return_value.Entity)
+	return_value.Config.UniqueId = return_value.UniqueId()
+	return_value.SetBaseTopic(self.EntityTopic(&return_value.Entity))
+
+	self.Entities = append(self.Entities, return_value)
+	return_value.NeedSendConfig = true
+
+	return return_value
+}
+
+func (self *HomeAssistant) ConfigureMissionCamera(device_id string, dev *Device) *Camera {
+	self.MissionCamera = self.ConfigureCamera(device_id, "mission_map", dev, "mdi:map-marker-path")
+	return self.MissionCamera
+}
+
+// SetMission update the camera image with the rendered map of a mission
+func (self *Camera) SetMission(mission *MissionMap, image []byte) {
+	self.State = CameraState(image)
+	self.Attributes["mission"] = mission.Id
+	self.Attributes["start"] = mission.Start
+	self.Attributes["end"] = mission.End
+	self.Attributes["points"] = len(mission.Points)
+	self.Attributes["initiator"] = mission.Initiator
+	self.NeedSendState = true
+	self.NeedSendAttributes = true
+}
+
 func (self *CleanPassSelect) CommandHandler(topic string, payload []byte) {
 	self.State = SelectState(payload)
 	self.NeedSendState = true
 }
 
 func (self *HomeAssistant) SendUpdate() {
+	// nothing is published until the entities are keyed by the robot blid
+	if self.RobotId == "" {
+		return
+	}
 	for i := range self.Entities {
 		vacuum, ok := self.Entities[i].(*Vacuum)
 		if ok {
@@ -289,13 +745,44 @@ func (self *HomeAssistant) SendUpdate() {
 			select_entity.SendState()
 			select_entity.SendAvaibality()
 		}
+
+		camera, ok := self.Entities[i].(*Camera)
+		if ok {
+			camera.SendConfig()
+			camera.SendAttributes()
+			camera.SendState()
+			camera.SendAvaibality()
+		}
+
+		button, ok := self.Entities[i].(*Button)
+		if ok {
+			button.SendConfig()
+			button.SendAvaibality()
+		}
+
+		trigger, ok := self.Entities[i].(*Trigger)
+		if ok {
+			trigger.SendConfig()
+		}
 	}
 }
 
-func ConfigureHomeAssistant(master_mqtt_topic string, master_mqtt_client MqttClient) HomeAssistant {
+// Republish send again the config, state and attributes of every entity
+func (self *HomeAssistant) Republish() {
+	for i := range self.Entities {
+		entity, ok := self.Entities[i].(interface{ MarkDirty() })
+		if ok {
+			entity.MarkDirty()
+		}
+	}
+	self.SendUpdate()
+}
+
+func ConfigureHomeAssistant(discovery_prefix string, master_mqtt_topic string, master_mqtt_client MqttClient) HomeAssistant {
 	return HomeAssistant{
-		ConfigBaseTopic:  "homeassistant",
+		ConfigBaseTopic:  discovery_prefix,
 		CommandBaseTopic: master_mqtt_topic,
+		TopicTemplate:    MQTT_TOPIC_TEMPLATE,
 		MasterMqttClient: master_mqtt_client,
 	}
 }
@@ -306,11 +793,13 @@ func (self *Vacuum) SendConfig() {
 		if err != nil {
 			panic(err)
 		}
-		master_mqtt_client.Publish(self.ConfigTopic, data, 0, true)
+		if !self.publish(self.ConfigTopic, data) {
+			return
+		}
 		self.NeedSendConfig = false
 
 		for i := range self.HomeAssistant.Entities {
-			region, ok := self.HomeAssistant.Entities[i].(*RoombaRegionSwitch)
+			region, ok := self.HomeAssistant.Entities[i].(*Switch)
 			if ok {
 				region.NeedSendConfig = true
 			}
@@ -319,6 +808,21 @@ func (self *Vacuum) SendConfig() {
 			if ok {
 				select_entity.NeedSendConfig = true
 			}
+
+			camera, ok := self.HomeAssistant.Entities[i].(*Camera)
+			if ok {
+				camera.NeedSendConfig = true
+			}
+
+			button, ok := self.HomeAssistant.Entities[i].(*Button)
+			if ok {
+				button.NeedSendConfig = true
+			}
+
+			trigger, ok := self.HomeAssistant.Entities[i].(*Trigger)
+			if ok {
+				trigger.NeedSendConfig = true
+			}
 		}
 	}
 }
@@ -328,7 +832,9 @@ func (self *Switch) SendConfig() {
 		if err != nil {
 			panic(err)
 		}
-		master_mqtt_client.Publish(self.ConfigTopic, data, global_qos_value, global_retain_value)
+		if !self.publish(self.ConfigTopic, data) {
+			return
+		}
 		self.NeedSendConfig = false
 	}
 }
@@ -338,7 +844,45 @@ func (self *Select) SendConfig() {
 		if err != nil {
 			panic(err)
 		}
-		master_mqtt_client.Publish(self.ConfigTopic, data, global_qos_value, global_retain_value)
+		if !self.publish(self.ConfigTopic, data) {
+			return
+		}
+		self.NeedSendConfig = false
+	}
+}
+func (self *Camera) SendConfig() {
+	if self.NeedSendConfig {
+		data, err := json.Marshal(self.Config)
+		if err != nil {
+			panic(err)
+		}
+		if !self.publish(self.ConfigTopic, data) {
+			return
+		}
+		self.NeedSendConfig = false
+	}
+}
+func (self *Button) SendConfig() {
+	if self.NeedSendConfig {
+		data, err := json.Marshal(self.Config)
+		if err != nil {
+			panic(err)
+		}
+		if !self.publish(self.ConfigTopic, data) {
+			return
+		}
+		self.NeedSendConfig = false
+	}
+}
+func (self *Trigger) SendConfig() {
+	if self.NeedSendConfig {
+		data, err := json.Marshal(self.Config)
+		if err != nil {
+			panic(err)
+		}
+		if !self.publish(self.ConfigTopic, data) {
+			return
+		}
 		self.NeedSendConfig = false
 	}
 }
@@ -350,7 +894,9 @@ func (self *Vacuum) SendState() {
 		if err != nil {
 			panic(err)
 		}
-		master_mqtt_client.Publish(self.Config.StateTopic, data, global_qos_value, global_retain_value)
+		if !self.publish(self.Config.StateTopic, data) {
+			return
+		}
 		self.NeedSendState = false
 	}
 }
@@ -363,7 +909,9 @@ func (self *Switch) SendState() {
 		} else {
 			data = []byte(self.Config.PayloadOff)
 		}
-		master_mqtt_client.Publish(self.Config.StateTopic, data, global_qos_value, global_retain_value)
+		if !self.publish(self.Config.StateTopic, data) {
+			return
+		}
 		self.NeedSendState = false
 	}
 }
@@ -371,39 +919,71 @@ func (self *Switch) SendState() {
 func (self *Select) SendState() {
 	if self.NeedSendState {
 		data := []byte(self.State)
-		master_mqtt_client.Publish(self.Config.StateTopic, data, global_qos_value, global_retain_value)
+		if !self.publish(self.Config.StateTopic, data) {
+			return
+		}
+		self.NeedSendState = false
+	}
+}
+
+func (self *Camera) SendState() {
+	if self.NeedSendState && len(self.State) > 0 {
+		if !self.publish(self.Config.Topic, []byte(self.State)) {
+			return
+		}
 		self.NeedSendState = false
 	}
 }
 
 func (self *Vacuum) SendAvaibality() {
-	master_mqtt_client.Publish(self.Config.AvailabilityTopic, []byte("online"), global_qos_value, global_retain_value)
+	self.publish(self.Config.AvailabilityTopic, []byte("online"))
 }
 func (self *Switch) SendAvaibality() {
-	master_mqtt_client.Publish(self.Config.AvailabilityTopic, []byte("online"), global_qos_value, global_retain_value)
+	self.publish(self.Config.AvailabilityTopic, []byte("online"))
 }
 func (self *Select) SendAvaibality() {
-	master_mqtt_client.Publish(self.Config.AvailabilityTopic, []byte("online"), global_qos_value, global_retain_value)
+	self.publish(self.Config.AvailabilityTopic, []byte("online"))
+}
+func (self *Camera) SendAvaibality() {
+	self.publish(self.Config.AvailabilityTopic, []byte("online"))
+}
+func (self *Button) SendAvaibality() {
+	self.publish(self.Config.AvailabilityTopic, []byte("online"))
 }
 
 func (self *Vacuum) SendAttributes() {
 	if self.NeedSendAttributes {
 		data, _ := json.Marshal(self.Attributes)
-		self.HomeAssistant.MasterMqttClient.Publish(self.Config.JsonAttributesTopic, data, global_qos_value, global_retain_value)
+		if !self.publish(self.Config.JsonAttributesTopic, data) {
+			return
+		}
 		self.NeedSendAttributes = false
 	}
 }
 func (self *Switch) SendAttributes() {
 	if self.NeedSendAttributes {
 		data, _ := json.Marshal(self.Attributes)
-		self.HomeAssistant.MasterMqttClient.Publish(self.Config.JsonAttributesTopic, data, global_qos_value, global_retain_value)
+		if !self.publish(self.Config.JsonAttributesTopic, data) {
+			return
+		}
 		self.NeedSendAttributes = false
 	}
 }
 func (self *Select) SendAttributes() {
 	if self.NeedSendAttributes {
 		data, _ := json.Marshal(self.Attributes)
-		self.HomeAssistant.MasterMqttClient.Publish(self.Config.JsonAttributesTopic, data, global_qos_value, global_retain_value)
+		if !self.publish(self.Config.JsonAttributesTopic, data) {
+			return
+		}
+		self.NeedSendAttributes = false
+	}
+}
+func (self *Camera) SendAttributes() {
+	if self.NeedSendAttributes {
+		data, _ := json.Marshal(self.Attributes)
+		if !self.publish(self.Config.JsonAttributesTopic, data) {
+			return
+		}
 		self.NeedSendAttributes = false
 	}
 }
@@ -414,61 +994,132 @@ func (self *RoombaRegionSwitch) CommandHandler(topic string, payload []byte) {
 	self.Switch.SendState()
 }
 
-func (self *Vacuum) CommandHandler(topic string, payload []byte) {
-	command_requested := string(payload)
-	cmd := Command{
-		Time:      0,
-		Initiator: "localApp",
-	}
-	if command_requested == "start" {
-		if self.State.State == paused_state {
-			cmd.Command = "resume"
-		} else {
-			cmd.Command = "start"
+func NewRoombaRegion(region *Region, two_pass bool) RoombaRegion {
+	return RoombaRegion{
+		RegionId: region.Id,
+		Type:     region.Type,
+		Params: RoombaRegionParams{
+			NoAutoPasses: true,
+			TwoPass:      two_pass,
+		},
+	}
+}
+
+// SelectedRegions return the regions whose switch is on
+func (self *Vacuum) SelectedRegions() (string, []RoombaRegion) {
+	pmap_id := ""
+	regions := []RoombaRegion{}
+	two_pass := false
+	if self.HomeAssistant.CleanPassSelect != nil && strings.ToLower(string(self.HomeAssistant.CleanPassSelect.State)) == "two" {
+		two_pass = true
+	}
+	for i := range self.HomeAssistant.RegionSwitches {
+		region_switch := self.HomeAssistant.RegionSwitches[i]
+		if region_switch.State {
+			pmap_id = region_switch.Map.Id
+			regions = append(regions, NewRoombaRegion(region_switch.Region, two_pass))
 		}
 	}
-	if command_requested == "stop" {
-		cmd.Command = "stop"
+	return pmap_id, regions
+}
+
+func SendRobotCommand(robot_client MqttClient, cmd Command) error {
+	if cmd.Time == 0 {
+		cmd.Time = time.Now().Unix()
+	}
+	if cmd.Initiator == "" {
+		cmd.Initiator = COMMAND_INITIATOR
 	}
-	if command_requested == "pause" {
-		cmd.Command = "pause"
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
 	}
-	if command_requested == "return_to_base" {
-		if self.State.State == cleaning_state {
-			cmd.Command = "stop"
-			data, _ := json.Marshal(cmd)
-			self.HomeAssistant.MqttClient.Publish("cmd", data, 0, false)
-			time.Sleep(15 * time.Second)
+	return robot_client.Publish("cmd", data, 0, false)
+}
+
+// MissionInitiator return the initiator of the mission of a
+// cleanMissionStatus. The robot reports COMMAND_INITIATOR for the missions of
+// the bridge, a mission starting within COMMAND_STEP_TIMEOUT of a start
+// command of the bridge is reported as bridge_initiator instead. It runs on
+// the loop.
+func (self *Vacuum) MissionInitiator(status *CleanMissionStatus) string {
+	if !missionCycle(status.Cycle) {
+		if status.Cycle != "" {
+			self.mission_initiator = ""
 		}
-		cmd.Command = "dock"
+		return status.Initiator
 	}
-	if command_requested == "locate" {
-		log.Warn().Msg("locate")
-		return
+	if self.mission_initiator == "" {
+		self.mission_initiator = status.Initiator
+		if status.Initiator == COMMAND_INITIATOR && time.Since(self.command_time) < COMMAND_STEP_TIMEOUT {
+			self.mission_initiator = bridge_initiator
+		}
 	}
-	if command_requested == "clean_spot" {
-		cmd.Command = "start"
+	return self.mission_initiator
+}
 
-		for i := range self.HomeAssistant.RegionSwitches {
-			region_switch := self.HomeAssistant.RegionSwitches[i]
-			twoPasses := false
-			if strings.ToLower(string(self.HomeAssistant.CleanPassSelect.State)) == "two" {
-				twoPasses = true
+// sendCommand publish a robot command from the loop
+func (self *Vacuum) sendCommand(cmd Command) error {
+	err := ErrRobotDisconnected
+	self.HomeAssistant.Loop.Call(func() {
+		if self.HomeAssistant.MqttClient != nil {
+			err = SendRobotCommand(self.HomeAssistant.MqttClient, cmd)
+			if err != nil {
+				err = fmt.Errorf("%w: %s", ErrRobotDisconnected, err)
+			} else if cmd.Command == "start" || cmd.Command == "resume" || cmd.Command == "train" {
+				self.command_time = time.Now()
 			}
-			if region_switch.State {
-				cmd.PmapId = region_switch.Map.Id
-				cmd.Regions = append(cmd.Regions, RoombaRegion{
-					RegionId: region_switch.Region.Id,
-					Type:     region_switch.Region.Type,
-					Params: RoombaRegionParams{
-						NoAutoPasses: true,
-						TwoPass:      twoPasses,
-					},
-				})
+		}
+	})
+	return err
+}
+
+// ExecuteCommand translate a vacuum command into a sequence of robot commands
+// and run it, the result is published on the result topic. When rooms is
+// requested without regions, the regions selected with the region switches
+// are cleaned. clean_spot is a deprecated alias of rooms kept for the existing
+// automations, the clean_rooms button replace it. It runs on the command
+// goroutine of the loop and read the state through it.
+func (self *Vacuum) ExecuteCommand(command_requested string, pmap_id string, regions []RoombaRegion) error {
+	start := time.Now()
+	if command_requested == "clean_spot" {
+		log.Warn().Msg("clean_spot is deprecated, use the rooms command or the clean_rooms button")
+	}
+
+	var phase, blid, name string
+	self.HomeAssistant.Loop.Call(func() {
+		phase = self.Phase
+		blid, name = self.Config.Device.Identifiers[0], self.Config.Name
+		if (command_requested == "clean_spot" || command_requested == "rooms") && len(regions) == 0 {
+			pmap_id, regions = self.SelectedRegions()
+		}
+	})
+
+	result := CommandResult{Command: command_requested, Steps: []string{}}
+	steps, err := CommandSequence(command_requested, phase, pmap_id, regions)
+	if err == nil {
+		for i := range steps {
+			if steps[i].Command.Command != "" {
+				result.Steps = append(result.Steps, steps[i].Command.Command)
 			}
 		}
+		err = self.RunSequence(steps)
 	}
 
-	data, _ := json.Marshal(cmd)
-	self.HomeAssistant.MqttClient.Publish("cmd", data, 0, false)
+	result.Duration = time.Since(start).Seconds()
+	result.Success = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		metric_command_latency.Observe(result.Duration, blid, name, command_requested)
+	}
+	self.HomeAssistant.Loop.Call(func() {
+		self.SendResult(result)
+	})
+	return err
+}
+
+// CommandHandler queue the command, the errors are logged by the loop
+func (self *Vacuum) CommandHandler(topic string, payload []byte) {
+	self.HomeAssistant.Loop.Queue(RobotCommand{Command: string(payload)})
 }
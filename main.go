@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"os/signal"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -38,6 +41,16 @@ type Client struct {
 	ConnectionChannel chan MqttClient `json:"-"`
 	SubscribeChannel  chan bool       `json:"-"`
 	Maps              []*Map
+	Missions          *MissionRecorder       `json:"-"`
+	Connected         bool                   `json:"-"`
+	DisconnectedSince time.Time              `json:"-"`
+	LastMessage       time.Time              `json:"-"`
+	Shadow            map[string]interface{} `json:"-"`
+	flatten_base      string
+	events            RobotEvents
+	NeedCleanup       bool     `json:"-"`
+	Capture           *Capture `json:"-"`
+	mutex             sync.Mutex
 }
 
 var vacuum_client_list []*Client
@@ -46,6 +59,7 @@ var master_mqtt_config MqttConfig
 var master_mqtt_client MqttClient
 
 var master_mqtt_topic string = "roomba2mqtt"
+var HA_DISCOVERY_PREFIX = "homeassistant"
 
 const (
 	cleaning_state  string = "cleaning"
@@ -67,21 +81,61 @@ var StateMap map[string]string = map[string]string{
 	"stuck":     error_state,
 }
 
+var HA_STATUS_TOPIC = ""
+var HA_BIRTH_MAX_DELAY = 5 * time.Second
+var ha_birth_random = rand.New(rand.NewSource(time.Now().UnixNano()))
+
 var DEBUG bool = false
 var DEBUG_FOLDER = "/debug"
 var DATA_FOLDER = "/data"
 
+// Id return the robot blid, the roomba MQTT user is the blid until the robot
+// reports it
+func (self *Client) Id() string {
+	if self.RoombaId != "" {
+		return self.RoombaId
+	}
+	return self.MqttConfig.Username
+}
+
+func (self *Client) Name() string {
+	return self.HomeAssistant.Vacuum.Config.Name
+}
+
+// LockedId return the robot id outside of the loop, the loop set it when the
+// robot reports its blid
+func (self *Client) LockedId() string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.Id()
+}
+
+func (self *Client) LockedName() string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.Name()
+}
+
 func (self *Client) UpdateRoombaMessage(msg RoombaMessage) {
 	// Config Vacuum
 	if msg.State.Reported.Name != nil {
 		self.HomeAssistant.Vacuum.Config.Name = *msg.State.Reported.Name
 		self.HomeAssistant.Vacuum.Config.Device.Name = *msg.State.Reported.Name
+		if self.HomeAssistant.RobotName != *msg.State.Reported.Name {
+			self.HomeAssistant.SetRobotName(*msg.State.Reported.Name)
+			self.NeedCleanup = true
+		}
 		self.Vacuum.NeedSendConfig = true
 	}
 
 	if msg.State.Reported.SKU != nil {
 		self.HomeAssistant.Vacuum.Config.Device.Model = *msg.State.Reported.SKU
 		self.Vacuum.NeedSendConfig = true
+		if self.HomeAssistant.ConfigureButtons(self.Id(), self.HomeAssistant.Vacuum.Config.Device, *msg.State.Reported.SKU) {
+			self.NeedCleanup = true
+		}
 	}
 
 	if msg.State.Reported.SoftwareVer != nil {
@@ -117,6 +171,7 @@ func (self *Client) UpdateRoombaMessage(msg RoombaMessage) {
 				}
 			}
 		}
+		self.RemoveDeletedMaps(*msg.State.Reported.Maps)
 	}
 
 	// Region
@@ -133,9 +188,11 @@ func (self *Client) UpdateRoombaMessage(msg RoombaMessage) {
 			if curren_map != nil {
 				for r := range msg.State.Reported.LastCommand.Regions {
 					region := msg.State.Reported.LastCommand.Regions[r]
-					curren_map.Regions[region.RegionId] = &Region{
-						Id:   region.RegionId,
-						Type: region.Type,
+					if _, ok := curren_map.Regions[region.RegionId]; !ok {
+						curren_map.Regions[region.RegionId] = &Region{
+							Id:   region.RegionId,
+							Type: region.Type,
+						}
 					}
 				}
 			}
@@ -163,6 +220,9 @@ func (self *Client) UpdateRoombaMessage(msg RoombaMessage) {
 					icon)
 				s.Region = self.Maps[m].Regions[r]
 				s.Map = self.Maps[m]
+				if s.Region.Name != "" {
+					s.Config.Name = s.Region.Name
+				}
 			}
 		}
 	}
@@ -222,12 +282,19 @@ func (self *Client) UpdateRoombaMessage(msg RoombaMessage) {
 	}
 
 	// State
+	initiator := ""
 	if msg.State.Reported.CleanMissionStatus != nil {
+		self.Vacuum.Phase = msg.State.Reported.CleanMissionStatus.Phase
 		self.Vacuum.State.State = StateMap[msg.State.Reported.CleanMissionStatus.Phase]
 		self.Vacuum.NeedSendState = true
 		if msg.State.Reported.CleanMissionStatus.Phase == "stuck" {
 			self.Vacuum.Attributes["error"] = "Stuck"
 		}
+		initiator = self.Vacuum.MissionInitiator(msg.State.Reported.CleanMissionStatus)
+		if initiator != "" {
+			self.Vacuum.Attributes["initiator"] = initiator
+			self.Vacuum.NeedSendAttributes = true
+		}
 	}
 	if msg.State.Reported.BatteryPercent != nil {
 		self.Vacuum.State.BatteryLevel = *msg.State.Reported.BatteryPercent
@@ -237,33 +304,151 @@ func (self *Client) UpdateRoombaMessage(msg RoombaMessage) {
 		self.Vacuum.State.State = "error"
 		self.Vacuum.NeedSendState = true
 	}
+
+	self.HomeAssistant.FireEvents(self.events.Update(msg.State.Reported))
+
+	// Mission map
+	if self.Missions != nil {
+		if msg.State.Reported.CleanMissionStatus != nil {
+			// same rule as the mission triggers, dock and evac cycles are
+			// not missions
+			cycle := msg.State.Reported.CleanMissionStatus.Cycle
+			if missionCycle(cycle) && !self.Missions.IsActive() {
+				self.Missions.StartMission(initiator)
+			}
+			if cycle != "" && !missionCycle(cycle) {
+				mission := self.Missions.FinishMission()
+				if mission != nil {
+					self.UpdateMissionCamera(mission)
+				}
+			}
+		}
+		if msg.State.Reported.Pose != nil {
+			self.Missions.AddPose(*msg.State.Reported.Pose)
+		}
+	}
 }
 
-func (self *Client) VacuumHandleMessage(topic string, payload []byte) {
-	roombaId := ""
-	if strings.HasPrefix(topic, "$aws") {
-		roombaId = strings.Split(topic, "/")[2]
+// RemoveDeletedMaps forget the maps the robot does not report anymore and
+// the switches of their regions
+func (self *Client) RemoveDeletedMaps(reported []MapMap) {
+	reported_ids := map[string]bool{}
+	for i := range reported {
+		for map_id := range reported[i] {
+			reported_ids[map_id] = true
+		}
 	}
 
-	if _, err := os.Stat(DEBUG_FOLDER); !os.IsNotExist(err) {
-		if roombaId != "" {
-			f, err := os.OpenFile(path.Join(DEBUG_FOLDER, roombaId), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-			if err == nil {
-				defer f.Close()
-				f.WriteString(topic)
-				f.WriteString("      ")
-				f.Write(payload)
-				f.WriteString("\n")
-			} else {
-				log.Error().Err(err).Msg("save payload to file")
+	maps := []*Map{}
+	for m := range self.Maps {
+		if reported_ids[self.Maps[m].Id] {
+			maps = append(maps, self.Maps[m])
+			continue
+		}
+		log.Info().Str("map", self.Maps[m].Id).Msg("Map removed")
+		for i := len(self.HomeAssistant.RegionSwitches) - 1; i >= 0; i-- {
+			if self.HomeAssistant.RegionSwitches[i].Map == self.Maps[m] {
+				self.HomeAssistant.RemoveRegionSwitch(self.HomeAssistant.RegionSwitches[i])
 			}
 		}
+		self.NeedCleanup = true
+	}
+	self.Maps = maps
+}
+
+// RenameRegion give a user friendly name to a region and its switch
+func (self *Client) RenameRegion(map_id string, region_id string, name string) error {
+	for m := range self.Maps {
+		if self.Maps[m].Id != map_id {
+			continue
+		}
+		region, ok := self.Maps[m].Regions[region_id]
+		if !ok {
+			break
+		}
+		region.Name = name
+		for i := range self.HomeAssistant.RegionSwitches {
+			region_switch := self.HomeAssistant.RegionSwitches[i]
+			if region_switch.Region == region {
+				region_switch.Config.Name = name
+				if name == "" {
+					region_switch.Config.Name = "zone_" + region.Type + region.Id
+				}
+				region_switch.NeedSendConfig = true
+			}
+		}
+		self.Save(DATA_FOLDER)
+		self.HomeAssistant.SendUpdate()
+		return nil
+	}
+	return errors.New("region not found")
+}
+
+// UpdateShadow merge a message received from the robot in the last known
+// reported state and return the reported part of the message
+func (self *Client) UpdateShadow(payload []byte) map[string]interface{} {
+	msg := map[string]interface{}{}
+	if json.Unmarshal(payload, &msg) != nil {
+		return nil
+	}
+	state, ok := msg["state"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	reported, ok := state["reported"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if self.Shadow == nil {
+		self.Shadow = map[string]interface{}{}
+	}
+	MergeShadow(self.Shadow, reported)
+	return reported
+}
+
+func MergeShadow(dst map[string]interface{}, src map[string]interface{}) {
+	for key, value := range src {
+		src_map, src_ok := value.(map[string]interface{})
+		dst_map, dst_ok := dst[key].(map[string]interface{})
+		if src_ok && dst_ok {
+			MergeShadow(dst_map, src_map)
+		} else {
+			dst[key] = value
+		}
+	}
+}
+
+func (self *Client) UpdateMissionCamera(mission *MissionMap) {
+	if self.HomeAssistant.MissionCamera == nil {
+		return
+	}
+	image, err := mission.RenderPng()
+	if err != nil {
+		log.Error().Err(err).Str("mission", mission.Id).Msg("Rendering mission map")
+		return
+	}
+	self.HomeAssistant.MissionCamera.SetMission(mission, image)
+}
+
+func (self *Client) VacuumHandleMessage(topic string, payload []byte) {
+	roombaId := ""
+	if strings.HasPrefix(topic, "$aws") {
+		roombaId = strings.Split(topic, "/")[2]
 	}
 
 	if roombaId != "" {
+		self.LastMessage = time.Now()
+		metric_messages_received.Inc(roombaId, self.Name(), topic)
 		if self.RoombaId == "" {
 			self.RoombaId = roombaId
+			self.MigrateDataFile(DATA_FOLDER)
 			self.Load(DATA_FOLDER)
+			self.HomeAssistant.SetRobotId(self.RoombaId)
+			self.Capture.SetRobotId(self.RoombaId)
+			self.Missions = NewMissionRecorder(DATA_FOLDER, self.RoombaId)
+			if mission := self.Missions.Latest(); mission != nil {
+				self.UpdateMissionCamera(mission)
+			}
 			if DEBUG {
 				self.HomeAssistant.ConfigureCleanPassSelect(self.RoombaId,
 					"clean_pass",
@@ -276,20 +461,26 @@ func (self *Client) VacuumHandleMessage(topic string, payload []byte) {
 
 			}
 		}
+		var reported map[string]interface{}
 		msg := RoombaMessage{}
 		err := json.Unmarshal(payload, &msg)
 		if err != nil {
 			log.Error().Err(err).Msg("Message received from roomba")
+			metric_decode_errors.Inc(roombaId, self.Name())
 		} else {
+			reported = self.UpdateShadow(payload)
 			self.UpdateRoombaMessage(msg)
 			self.Save(DATA_FOLDER)
 			self.HomeAssistant.SendUpdate()
+			// the buttons depend on the model, the entities are complete
+			// once the robot reported its SKU
+			if self.NeedCleanup && self.HomeAssistant.Vacuum.Config.Device.Model != "" {
+				self.CleanupRetained()
+				self.NeedCleanup = false
+			}
 		}
 
-		dst_topic := topic
-		dst_topic = path.Join(master_mqtt_topic, "raw", dst_topic)
-		master_mqtt_client.Publish(dst_topic, payload, 2, false)
-		log.Info().Str("broker", self.Broker).Str("dst_topic", dst_topic).Msg("mapping message")
+		self.PublishRaw(topic, payload, reported)
 	}
 }
 
@@ -313,6 +504,28 @@ func (self *Client) Save(data_dir string) string {
 	return ""
 }
 
+// MigrateDataFile rename the maps saved under the MQTT user by previous
+// versions so they are keyed by the robot blid
+func (self *Client) MigrateDataFile(data_dir string) {
+	if self.MqttConfig.Username == "" || self.MqttConfig.Username == self.RoombaId {
+		return
+	}
+	old_file_name := path.Join(data_dir, self.MqttConfig.Username+".json")
+	file_name := path.Join(data_dir, self.RoombaId+".json")
+	if _, err := os.Stat(file_name); !os.IsNotExist(err) {
+		return
+	}
+	if _, err := os.Stat(old_file_name); err != nil {
+		return
+	}
+
+	log.Info().Str("from", old_file_name).Str("to", file_name).Msg("Migrating vacuum")
+	err := os.Rename(old_file_name, file_name)
+	if err != nil {
+		log.Error().Err(err).Msg("Migrating vacuum")
+	}
+}
+
 func (self *Client) Load(data_dir string) {
 	file_name := path.Join(data_dir, self.RoombaId+".json")
 
@@ -342,14 +555,160 @@ func NewMqttConfig(id int) (MqttConfig, error) {
 	}
 
 	return MqttConfig{
-		Broker:   os.Getenv(ROOMBA_ADDRESS),
-		Port:     8883,
-		Username: os.Getenv(ROOMBA_USER),
-		Password: os.Getenv(ROOMBA_PASSWORD),
-		Version:  0,
+		Broker:     os.Getenv(ROOMBA_ADDRESS),
+		Port:       8883,
+		Username:   os.Getenv(ROOMBA_USER),
+		Password:   os.Getenv(ROOMBA_PASSWORD),
+		Version:    0,
+		CleanStart: true,
+		Tls: MqttTlsConfig{
+			Enabled: true,
+			Legacy:  true,
+		},
 	}, nil
 }
 
+// NewMasterTlsConfig read the TLS settings of the master broker, TLS is
+// enabled on port 8883 unless MQTT_TLS says otherwise
+func NewMasterTlsConfig(port uint) (MqttTlsConfig, error) {
+	return_value := MqttTlsConfig{
+		Enabled:    port == 8883,
+		CaFile:     os.Getenv("MQTT_TLS_CA"),
+		CertFile:   os.Getenv("MQTT_TLS_CERT"),
+		KeyFile:    os.Getenv("MQTT_TLS_KEY"),
+		ServerName: os.Getenv("MQTT_TLS_SERVER_NAME"),
+	}
+
+	var err error
+	if value, found := os.LookupEnv("MQTT_TLS"); found {
+		return_value.Enabled, err = strconv.ParseBool(value)
+		if err != nil {
+			return return_value, fmt.Errorf("MQTT_TLS: %w", err)
+		}
+	}
+	if value, found := os.LookupEnv("MQTT_TLS_INSECURE"); found {
+		return_value.InsecureSkipVerify, err = strconv.ParseBool(value)
+		if err != nil {
+			return return_value, fmt.Errorf("MQTT_TLS_INSECURE: %w", err)
+		}
+	}
+	if value, found := os.LookupEnv("MQTT_TLS_MIN_VERSION"); found {
+		version, ok := tls_versions[value]
+		if !ok {
+			return return_value, fmt.Errorf("MQTT_TLS_MIN_VERSION: unknown version %s", value)
+		}
+		return_value.MinVersion = version
+	}
+	return return_value, nil
+}
+
+// NewClient configure a robot and its Home Assistant entities, publishing on
+// the master client, and start its loop
+func NewClient(mqtt_config MqttConfig, master_client MqttClient) *Client {
+	client := &Client{
+		MqttConfig:        mqtt_config,
+		ConnectionChannel: make(chan MqttClient),
+		SubscribeChannel:  make(chan bool),
+		Maps:              []*Map{},
+		DisconnectedSince: time.Now(),
+		NeedCleanup:       true,
+		Capture:           NewCapture(DEBUG_FOLDER, mqtt_config.Username), // moved to the robot id once reported
+	}
+	client.HomeAssistant = ConfigureHomeAssistant(HA_DISCOVERY_PREFIX, master_mqtt_topic, &MetricsMqttClient{
+		MqttClient: &RetainedMqttClient{
+			MqttClient: &CaptureMqttClient{
+				MqttClient: master_client,
+				Capture:    client.Capture,
+				In:         capture_master_in,
+				Out:        capture_master_out,
+			},
+			Client: client,
+		},
+		Broker: "master",
+		Client: client,
+	})
+	client.HomeAssistant.Loop = NewRobotLoop(&client.mutex, client.ExecuteCommand)
+	client.HomeAssistant.Loop.Start()
+	// entities are keyed by the blid once the robot reports it
+	client.HomeAssistant.ConfigureVacuum(client.MqttConfig.Username)
+	client.HomeAssistant.ConfigureMissionCamera(client.MqttConfig.Username, client.HomeAssistant.Vacuum.Config.Device)
+	client.HomeAssistant.CaptureSwitch = client.HomeAssistant.ConfigureCaptureSwitch(client.MqttConfig.Username, client.HomeAssistant.Vacuum.Config.Device, client.Capture)
+	client.HomeAssistant.ConfigureTriggers(client.MqttConfig.Username, client.HomeAssistant.Vacuum.Config.Device)
+	return client
+}
+
+// NewMasterMqttConfig read the master broker configuration
+func NewMasterMqttConfig() (MqttConfig, error) {
+	port, _ := strconv.Atoi(os.Getenv("MQTT_PORT"))
+	if port == 0 {
+		port = 1883
+	}
+	return_value := MqttConfig{
+		Broker:   os.Getenv("MQTT_ADDRESS"),
+		Url:      os.Getenv("MQTT_URL"),
+		Port:     uint(port),
+		Username: os.Getenv("MQTT_USER"),
+		Password: os.Getenv("MQTT_PASSWORD"),
+	}
+	err := NewMasterSessionConfig(&return_value)
+	if err != nil {
+		return return_value, err
+	}
+	if broker_url, _, err := return_value.BrokerUrl(); err == nil && return_value.Broker == "" {
+		return_value.Broker = broker_url.Hostname()
+	}
+	return_value.Tls, err = NewMasterTlsConfig(return_value.Port)
+	return return_value, err
+}
+
+// NewMasterSessionConfig read the protocol and session options of the master
+// connection
+func NewMasterSessionConfig(config *MqttConfig) error {
+	config.Version = 5
+	if value, found := os.LookupEnv("MQTT_VERSION"); found {
+		version, ok := mqtt_versions[value]
+		if !ok {
+			return fmt.Errorf("MQTT_VERSION: unknown version %s", value)
+		}
+		config.Version = version
+	}
+
+	config.ClientId = os.Getenv("MQTT_CLIENT_ID")
+	if config.ClientId == "" {
+		// the user may be shared by several bridges, the hostname is the
+		// container id under docker
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = strconv.Itoa(os.Getpid())
+		}
+		config.ClientId = "roomba2mqtt-" + hostname
+	}
+
+	config.CleanStart = true
+	if value, found := os.LookupEnv("MQTT_CLEAN_START"); found {
+		clean_start, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("MQTT_CLEAN_START: %w", err)
+		}
+		config.CleanStart = clean_start
+	}
+	if value, found := os.LookupEnv("MQTT_SESSION_EXPIRY"); found {
+		expiry, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("MQTT_SESSION_EXPIRY: %w", err)
+		}
+		config.SessionExpiry = uint32(expiry.Seconds())
+	}
+	if value, found := os.LookupEnv("MQTT_KEEPALIVE"); found {
+		keepalive, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("MQTT_KEEPALIVE: %w", err)
+		}
+		config.KeepAlive = uint16(keepalive.Seconds())
+	}
+	return nil
+}
+
 func main() {
 	//GetCredential()
 	debug_str := os.Getenv("DEBUG")
@@ -362,6 +721,108 @@ func main() {
 	if found {
 		DATA_FOLDER = p
 	}
+	p, found = os.LookupEnv("HTTP_ADDRESS")
+	if found {
+		HTTP_ADDRESS = p
+	}
+	HTTP_USER = os.Getenv("HTTP_USER")
+	HTTP_PASSWORD = os.Getenv("HTTP_PASSWORD")
+	retain, err := strconv.Atoi(os.Getenv("MISSION_MAP_RETAIN"))
+	if err == nil {
+		MISSION_MAP_RETAIN = retain
+	}
+	step_timeout, err := time.ParseDuration(os.Getenv("COMMAND_STEP_TIMEOUT"))
+	if err == nil {
+		COMMAND_STEP_TIMEOUT = step_timeout
+	}
+	dock_timeout, err := time.ParseDuration(os.Getenv("COMMAND_DOCK_TIMEOUT"))
+	if err == nil {
+		COMMAND_DOCK_TIMEOUT = dock_timeout
+	}
+	capture_size, err := strconv.ParseInt(os.Getenv("CAPTURE_MAX_SIZE"), 10, 64)
+	if err == nil {
+		CAPTURE_MAX_SIZE = capture_size
+	}
+	capture_files, err := strconv.Atoi(os.Getenv("CAPTURE_MAX_FILES"))
+	if err == nil {
+		CAPTURE_MAX_FILES = capture_files
+	}
+	queue_size, err := strconv.Atoi(os.Getenv("MQTT_QUEUE_SIZE"))
+	if err == nil {
+		MQTT_QUEUE_SIZE = queue_size
+	}
+	queue_retry, err := time.ParseDuration(os.Getenv("MQTT_QUEUE_RETRY"))
+	if err == nil {
+		MQTT_QUEUE_RETRY = queue_retry
+	}
+	tolerance, err := time.ParseDuration(os.Getenv("READY_ROBOT_TOLERANCE"))
+	if err == nil {
+		READY_ROBOT_TOLERANCE = tolerance
+	}
+	p, found = os.LookupEnv("MQTT_BASE_TOPIC")
+	if found {
+		master_mqtt_topic = p
+	}
+	raw_enabled, err := strconv.ParseBool(os.Getenv("RAW_ENABLED"))
+	if err == nil {
+		RAW_ENABLED = raw_enabled
+	}
+	p, found = os.LookupEnv("RAW_TOPIC")
+	if found {
+		RAW_TOPIC = p
+	}
+	RAW_SHADOW, _ = strconv.ParseBool(os.Getenv("RAW_SHADOW"))
+	RAW_FLATTEN, _ = strconv.ParseBool(os.Getenv("RAW_FLATTEN"))
+	p, found = os.LookupEnv("RAW_FLATTEN_TOPIC")
+	if found {
+		RAW_FLATTEN_TOPIC = p
+	}
+	if p = os.Getenv("RAW_FLATTEN_KEYS"); p != "" {
+		RAW_FLATTEN_KEYS = strings.Split(p, ",")
+	}
+	raw_command_enabled, err := strconv.ParseBool(os.Getenv("RAW_COMMAND_ENABLED"))
+	if err == nil {
+		RAW_COMMAND_ENABLED = raw_command_enabled
+	}
+	p, found = os.LookupEnv("RAW_COMMAND_TOPIC")
+	if found {
+		RAW_COMMAND_TOPIC = p
+	}
+	if p = os.Getenv("RAW_COMMAND_ALLOWLIST"); p != "" {
+		RAW_COMMAND_ALLOWLIST = strings.Split(p, ",")
+	}
+	if p = os.Getenv("RAW_DELTA_ALLOWLIST"); p != "" {
+		RAW_DELTA_ALLOWLIST = strings.Split(p, ",")
+	}
+	p, found = os.LookupEnv("COMMAND_INITIATOR")
+	if found {
+		COMMAND_INITIATOR = p
+	}
+	p, found = os.LookupEnv("MQTT_TOPIC_TEMPLATE")
+	if found {
+		MQTT_TOPIC_TEMPLATE = p
+	}
+	p, found = os.LookupEnv("HA_DISCOVERY_PREFIX")
+	if found {
+		HA_DISCOVERY_PREFIX = p
+	}
+	HA_STATUS_TOPIC = path.Join(HA_DISCOVERY_PREFIX, "status")
+	p, found = os.LookupEnv("HA_STATUS_TOPIC")
+	if found {
+		HA_STATUS_TOPIC = p
+	}
+	birth_delay, err := time.ParseDuration(os.Getenv("HA_BIRTH_MAX_DELAY"))
+	if err == nil {
+		HA_BIRTH_MAX_DELAY = birth_delay
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		endpoint := "healthz"
+		if len(os.Args) > 2 {
+			endpoint = os.Args[2]
+		}
+		os.Exit(Healthcheck(HTTP_ADDRESS, endpoint))
+	}
 
 	if DEBUG {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
@@ -374,6 +835,14 @@ func main() {
 
 	log.Info().Msg("Started")
 
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		err = Simulate()
+		if err != nil {
+			log.Error().Err(err).Msg("simulator")
+			os.Exit(1)
+		}
+	}
+
 	signal_channel := make(chan os.Signal, 2)
 	stop_channel := make(chan bool, 2)
 	signal.Notify(signal_channel, os.Interrupt, syscall.SIGTERM)
@@ -382,55 +851,67 @@ func main() {
 		stop_channel <- true
 	}(signal_channel)
 
-	var err error
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(Replay(os.Args[2:]))
+	}
 
 	// master mqtt client
-	port, _ := strconv.Atoi(os.Getenv("MQTT_PORT"))
-	if port == 0 {
-		port = 1883
-	}
-	master_mqtt_config = MqttConfig{
-		Broker:   os.Getenv("MQTT_ADDRESS"),
-		Port:     uint(port),
-		Username: os.Getenv("MQTT_USER"),
-		Password: os.Getenv("MQTT_PASSWORD"),
-		Version:  5,
-	}
-	master_mqtt_client, err = NewMqttClient(master_mqtt_config)
+	master_mqtt_config, err = NewMasterMqttConfig()
 	if err != nil {
-		log.Error().Err(err).Msg("master MQTT connection")
+		log.Error().Err(err).Msg("master MQTT configuration")
 		panic(err)
 	}
-	err = master_mqtt_client.Connect()
+	mqtt_client, err := NewMqttClient(master_mqtt_config)
 	if err != nil {
 		log.Error().Err(err).Msg("master MQTT connection")
 		panic(err)
 	}
-	log.Info().Msg("master MQTT connected")
+	master_mqtt_queue = NewQueuedMqttClient(mqtt_client, MQTT_QUEUE_SIZE)
+	master_mqtt_client = master_mqtt_queue
+	retained_registry = LoadRetainedRegistry(DATA_FOLDER)
+	if len(os.Args) > 1 && os.Args[1] == "purge" {
+		os.Exit(Purge())
+	}
+	master_mqtt_client.OnConnectionUp(MasterConnectionUp)
+	master_mqtt_client.OnConnectionLost(func(err error) {
+		SetMasterConnected(false)
+		log.Warn().Err(err).Msg("master MQTT connection lost")
+	})
+	if HA_STATUS_TOPIC != "" {
+		master_mqtt_client.Subscribe(HA_STATUS_TOPIC, HomeAssistantStatusHandler)
+	}
 
 	// configure roomba
 	for i := 0; i < 10; i++ {
 		log.Debug().Int("index", i).Msg("env variable loading")
 
-		client := &Client{
-			ConnectionChannel: make(chan MqttClient),
-			SubscribeChannel:  make(chan bool),
-			Maps:              []*Map{},
-		}
-		client.MqttConfig, err = NewMqttConfig(i)
+		mqtt_config, err := NewMqttConfig(i)
 		if err != nil {
 			break
 		}
-		client.HomeAssistant = ConfigureHomeAssistant(master_mqtt_topic, master_mqtt_client)
-		client.HomeAssistant.ConfigureVacuum(client.MqttConfig.Username)
+		client := NewClient(mqtt_config, master_mqtt_client)
 
 		vacuum_client_list = append(vacuum_client_list, client)
 		log.Info().Int("index", i).Msg("env variable loaded")
 	}
 
+	if HTTP_ADDRESS != "" {
+		StartWebServer(HTTP_ADDRESS)
+	}
+
+	// connect to master, robots connect in parallel and their updates are
+	// published once the master is up
+	go ConnectWithBackoff("master", master_mqtt_config, func() error {
+		err := master_mqtt_client.Connect()
+		if err != nil {
+			metric_reconnects.Inc("", "master")
+		}
+		return err
+	})
+
 	// connect to roomba
 	for i := range vacuum_client_list {
-		go ConnectToRoomba(vacuum_client_list[i].MqttConfig, vacuum_client_list[i].ConnectionChannel)
+		go ConnectToRoomba(vacuum_client_list[i])
 	}
 
 	// Subscribe to roomba
@@ -444,54 +925,149 @@ func main() {
 	}
 
 	<-stop_channel
+	Shutdown()
 }
 
-func SubscribeToRoomba(client *Client, subscribe_channel chan bool) {
-	mqtt_client := <-client.ConnectionChannel
+// Shutdown close the robot and master connections
+func Shutdown() {
+	log.Info().Msg("Stopping")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	client.Vacuum.HomeAssistant.MqttClient = mqtt_client
+	for i := range vacuum_client_list {
+		client := vacuum_client_list[i]
+		var robot_client MqttClient
+		client.Loop.Call(func() {
+			robot_client = client.HomeAssistant.MqttClient
+		})
+		if robot_client == nil {
+			continue
+		}
+		err := robot_client.Disconnect(ctx)
+		if err != nil {
+			log.Error().Err(err).Str("roomba", client.LockedId()).Msg("Roomba MQTT disconnect")
+		}
+	}
+	err := master_mqtt_client.Disconnect(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("master MQTT disconnect")
+	}
+}
 
-	client.Vacuum.HomeAssistant.MqttClient.Subscribe("#", client.VacuumHandleMessage)
+func SubscribeToRoomba(client *Client, subscribe_channel chan bool) {
+	mqtt_client := MqttClient(&CaptureMqttClient{
+		MqttClient: <-client.ConnectionChannel,
+		Capture:    client.Capture,
+		In:         capture_robot_in,
+		Out:        capture_robot_out,
+	})
 
-	master_mqtt_client.Subscribe(client.HomeAssistant.Vacuum.Config.CommandTopic, client.Vacuum.CommandHandler)
+	client.Loop.Call(func() {
+		client.HomeAssistant.MqttClient = &MetricsMqttClient{
+			MqttClient: mqtt_client,
+			Broker:     "robot",
+			Client:     client,
+		}
+		client.HomeAssistant.SubscribeCommands()
+	})
+	client.SetConnected(true)
+	mqtt_client.OnConnectionUp(func() {
+		client.SetConnected(true)
+		log.Info().Str("roomba", client.LockedId()).Msg("Roomba MQTT reconnected")
+	})
+	mqtt_client.OnConnectionLost(func(err error) {
+		client.SetConnected(false)
+		log.Warn().Err(err).Str("roomba", client.LockedId()).Msg("Roomba MQTT connection lost")
+	})
+
+	// # does not match the $aws topics of the robot
+	mqtt_client.Subscribe("#", client.Loop.Handler(client.VacuumHandleMessage))
+	mqtt_client.Subscribe("$aws/#", client.Loop.Handler(client.VacuumHandleMessage))
 
 	subscribe_channel <- true
 }
 
-func ConnectToRoomba(config MqttConfig, connection_channel chan MqttClient) {
-	timing := []time.Duration{
-		10 * time.Second,
-		30 * time.Second,
-		1 * time.Minute,
-		5 * time.Minute,
-		10 * time.Minute,
+// MasterConnectionUp is called on each connection to the master broker,
+// everything is published again as a non persistent broker may have lost the
+// retained messages
+func MasterConnectionUp() {
+	SetMasterConnected(true)
+	log.Info().Msg("master MQTT connected")
+
+	CleanupRemovedRobots()
+	for i := range vacuum_client_list {
+		client := vacuum_client_list[i]
+		client.Loop.Post(client.HomeAssistant.Republish)
+	}
+}
+
+// HomeAssistantStatusHandler republish everything when Home Assistant
+// announces it is back online. Each robot waits a random delay so the bridge
+// does not flood the broker while HA is starting.
+func HomeAssistantStatusHandler(topic string, payload []byte) {
+	if string(payload) != "online" {
+		return
 	}
+	log.Info().Str("topic", topic).Msg("Home Assistant online")
+
+	for i := range vacuum_client_list {
+		delay := time.Duration(0)
+		if HA_BIRTH_MAX_DELAY > 0 {
+			delay = time.Duration(ha_birth_random.Int63n(int64(HA_BIRTH_MAX_DELAY)))
+		}
+		go func(client *Client, delay time.Duration) {
+			time.Sleep(delay)
+			client.Loop.Post(client.HomeAssistant.Republish)
+		}(vacuum_client_list[i], delay)
+	}
+}
+
+var connection_timing []time.Duration = []time.Duration{
+	10 * time.Second,
+	30 * time.Second,
+	1 * time.Minute,
+	5 * time.Minute,
+	10 * time.Minute,
+}
+
+// ConnectWithBackoff call connect until it succeed, waiting longer after each
+// failure
+func ConnectWithBackoff(name string, config MqttConfig, connect func() error) {
 	timing_idx := 0
 	for {
-		log.Info().Str("address", config.Broker).Msg("Roomba MQTT connect")
+		log.Info().Str("address", config.Broker).Msg(name + " MQTT connect")
 
-		wait_time := timing[timing_idx]
+		wait_time := connection_timing[timing_idx]
 		timing_idx++
-		if timing_idx >= len(timing) {
+		if timing_idx >= len(connection_timing) {
 			timing_idx = timing_idx - 1
 		}
 
-		client, err := NewMqttClient(config)
-		if err != nil {
-			log.Error().Err(err).Str("wait_time", wait_time.String()).Msg("Roomba MQTT connection")
-			time.Sleep(wait_time)
-			continue
-		}
-		err = client.Connect()
+		err := connect()
 		if err != nil {
-			log.Error().Err(err).Str("wait_time", wait_time.String()).Msg("Roomba MQTT connection")
+			log.Error().Err(err).Str("wait_time", wait_time.String()).Msg(name + " MQTT connection")
 			time.Sleep(wait_time)
 			continue
 		}
 
-		log.Info().Msg("Roomba MQTT connected")
-
-		connection_channel <- client
+		log.Info().Msg(name + " MQTT connected")
 		return
 	}
 }
+
+func ConnectToRoomba(roomba *Client) {
+	var client MqttClient
+	ConnectWithBackoff("Roomba", roomba.MqttConfig, func() error {
+		var err error
+		client, err = NewMqttClient(roomba.MqttConfig)
+		if err == nil {
+			err = client.Connect()
+		}
+		if err != nil {
+			metric_reconnects.Inc(roomba.LockedId(), roomba.LockedName())
+		}
+		return err
+	})
+
+	roomba.ConnectionChannel <- client
+}
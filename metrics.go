@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Minimal Prometheus text exposition, the bridge only needs a handful of
+// counters, one histogram and gauges computed when scraped.
+
+type metricSample struct {
+	labels []string
+	value  float64
+}
+
+type CounterVec struct {
+	Name   string
+	Help   string
+	Labels []string
+	values map[string]*metricSample
+	mutex  sync.Mutex
+}
+
+type histogramSample struct {
+	labels  []string
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+type HistogramVec struct {
+	Name    string
+	Help    string
+	Labels  []string
+	Buckets []float64
+	values  map[string]*histogramSample
+	mutex   sync.Mutex
+}
+
+var metric_messages_received = &CounterVec{
+	Name:   "roomba2mqtt_messages_received_total",
+	Help:   "Messages received from the robots.",
+	Labels: []string{"blid", "name", "topic"},
+}
+var metric_publishes = &CounterVec{
+	Name:   "roomba2mqtt_publishes_total",
+	Help:   "MQTT messages published, broker is master or robot.",
+	Labels: []string{"blid", "name", "broker"},
+}
+var metric_publish_errors = &CounterVec{
+	Name:   "roomba2mqtt_publish_errors_total",
+	Help:   "MQTT messages that failed to be published.",
+	Labels: []string{"blid", "name", "broker"},
+}
+var metric_reconnects = &CounterVec{
+	Name:   "roomba2mqtt_reconnect_attempts_total",
+	Help:   "Connection attempts that failed and were retried.",
+	Labels: []string{"blid", "name"},
+}
+var metric_decode_errors = &CounterVec{
+	Name:   "roomba2mqtt_json_decode_errors_total",
+	Help:   "Robot messages that could not be decoded.",
+	Labels: []string{"blid", "name"},
+}
+var metric_command_latency = &HistogramVec{
+	Name:    "roomba2mqtt_command_duration_seconds",
+	Help:    "Time from the request of a successful command until the robot confirmed its last step.",
+	Labels:  []string{"blid", "name", "command"},
+	Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 15, 30, 60, 120, 300, 600, 1200},
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	pairs := []string{}
+	for i := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, names[i], escapeLabel(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabel(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func writeHeader(w io.Writer, name string, help string, metric_type string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metric_type)
+}
+
+func (self *CounterVec) Add(value float64, label_values ...string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.values == nil {
+		self.values = map[string]*metricSample{}
+	}
+	key := strings.Join(label_values, "\x00")
+	sample, ok := self.values[key]
+	if !ok {
+		sample = &metricSample{labels: label_values}
+		self.values[key] = sample
+	}
+	sample.value += value
+}
+
+func (self *CounterVec) Inc(label_values ...string) {
+	self.Add(1, label_values...)
+}
+
+func (self *CounterVec) Write(w io.Writer) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	writeHeader(w, self.Name, self.Help, "counter")
+	keys := []string{}
+	for key := range self.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		sample := self.values[key]
+		fmt.Fprintf(w, "%s%s %g\n", self.Name, formatLabels(self.Labels, sample.labels), sample.value)
+	}
+}
+
+func (self *HistogramVec) Observe(value float64, label_values ...string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.values == nil {
+		self.values = map[string]*histogramSample{}
+	}
+	key := strings.Join(label_values, "\x00")
+	sample, ok := self.values[key]
+	if !ok {
+		sample = &histogramSample{labels: label_values, buckets: make([]uint64, len(self.Buckets))}
+		self.values[key] = sample
+	}
+	for i := range self.Buckets {
+		if value <= self.Buckets[i] {
+			sample.buckets[i]++
+		}
+	}
+	sample.sum += value
+	sample.count++
+}
+
+func (self *HistogramVec) Write(w io.Writer) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	writeHeader(w, self.Name, self.Help, "histogram")
+	keys := []string{}
+	for key := range self.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		sample := self.values[key]
+		for i := range self.Buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", self.Name, formatLabels(self.Labels, sample.labels, "le", fmt.Sprintf("%g", self.Buckets[i])), sample.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", self.Name, formatLabels(self.Labels, sample.labels, "le", "+Inf"), sample.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", self.Name, formatLabels(self.Labels, sample.labels), sample.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", self.Name, formatLabels(self.Labels, sample.labels), sample.count)
+	}
+}
+
+// MetricsMqttClient count the publishes done through a client
+type MetricsMqttClient struct {
+	MqttClient
+	Broker string
+	Client *Client
+}
+
+func (self *MetricsMqttClient) labels() []string {
+	if self.Client == nil {
+		return []string{"", "", self.Broker}
+	}
+	return []string{self.Client.Id(), self.Client.Name(), self.Broker}
+}
+
+func (self *MetricsMqttClient) Publish(topic string, payload []byte, qos uint8, retain bool) error {
+	err := self.MqttClient.Publish(topic, payload, qos, retain)
+	metric_publishes.Inc(self.labels()...)
+	if err != nil {
+		metric_publish_errors.Inc(self.labels()...)
+	}
+	return err
+}
+
+func boolMetric(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+type robotGauges struct {
+	labels       []string
+	connected    bool
+	battery      int
+	state        string
+	bin_full     bool
+	tank_level   interface{}
+	mission_min  int
+	mission_sqft int
+}
+
+func (self *Client) gauges() robotGauges {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return_value := robotGauges{
+		labels:    []string{self.Id(), self.Name()},
+		connected: self.Connected,
+		battery:   self.HomeAssistant.Vacuum.State.BatteryLevel,
+		state:     self.HomeAssistant.Vacuum.State.State,
+	}
+	return_value.bin_full, _ = self.HomeAssistant.Vacuum.Attributes["bin_full"].(bool)
+	return_value.tank_level = self.HomeAssistant.Vacuum.Attributes["tank_level"]
+	if status, ok := self.Shadow["cleanMissionStatus"].(map[string]interface{}); ok {
+		if value, ok := status["mssnM"].(float64); ok {
+			return_value.mission_min = int(value)
+		}
+		if value, ok := status["sqft"].(float64); ok {
+			return_value.mission_sqft = int(value)
+		}
+	}
+	return return_value
+}
+
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	robots := []robotGauges{}
+	for i := range vacuum_client_list {
+		robots = append(robots, vacuum_client_list[i].gauges())
+	}
+	robot_labels := []string{"blid", "name"}
+
+	gauges := []struct {
+		name  string
+		help  string
+		value func(robotGauges) (float64, bool)
+	}{
+		{"roomba2mqtt_robot_connected", "Robot MQTT connection is up.", func(g robotGauges) (float64, bool) {
+			return boolMetric(g.connected), true
+		}},
+		{"roomba2mqtt_robot_battery_percent", "Battery level.", func(g robotGauges) (float64, bool) {
+			return float64(g.battery), true
+		}},
+		{"roomba2mqtt_robot_bin_full", "Bin is full.", func(g robotGauges) (float64, bool) {
+			return boolMetric(g.bin_full), true
+		}},
+		{"roomba2mqtt_robot_tank_level_percent", "Tank level of mopping robots.", func(g robotGauges) (float64, bool) {
+			switch value := g.tank_level.(type) {
+			case *int:
+				return float64(*value), true
+			case int:
+				return float64(value), true
+			}
+			return 0, false
+		}},
+		{"roomba2mqtt_robot_mission_minutes", "Duration of the current mission.", func(g robotGauges) (float64, bool) {
+			return float64(g.mission_min), true
+		}},
+		{"roomba2mqtt_robot_mission_sqft", "Area cleaned during the current mission.", func(g robotGauges) (float64, bool) {
+			return float64(g.mission_sqft), true
+		}},
+	}
+	for _, gauge := range gauges {
+		writeHeader(w, gauge.name, gauge.help, "gauge")
+		for i := range robots {
+			if value, ok := gauge.value(robots[i]); ok {
+				fmt.Fprintf(w, "%s%s %g\n", gauge.name, formatLabels(robot_labels, robots[i].labels), value)
+			}
+		}
+	}
+
+	states := []string{cleaning_state, docked_state, paused_state, idle_state, returning_state, error_state}
+	writeHeader(w, "roomba2mqtt_robot_state", "Current vacuum state, 1 for the active state.", "gauge")
+	for i := range robots {
+		for _, state := range states {
+			fmt.Fprintf(w, "roomba2mqtt_robot_state%s %g\n",
+				formatLabels(robot_labels, robots[i].labels, "state", state),
+				boolMetric(robots[i].state == state))
+		}
+	}
+
+	if master_mqtt_queue != nil {
+		writeHeader(w, "roomba2mqtt_publish_queue_length", "Messages waiting for the master broker.", "gauge")
+		fmt.Fprintf(w, "roomba2mqtt_publish_queue_length %d\n", master_mqtt_queue.Len())
+	}
+
+	metric_messages_received.Write(w)
+	metric_publishes.Write(w)
+	metric_publish_errors.Write(w)
+	metric_publish_dropped.Write(w)
+	metric_reconnects.Write(w)
+	metric_decode_errors.Write(w)
+	metric_command_latency.Write(w)
+}
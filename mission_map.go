@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Robot footprint in pose units (cm), used as brush size for the coverage
+const mission_brush_size float64 = 34
+const mission_map_size float64 = 800
+const mission_map_margin float64 = 20
+
+var MISSION_MAP_RETAIN int = 5
+
+var mission_background_color = color.RGBA{0xff, 0xff, 0xff, 0xff}
+var mission_coverage_color = color.RGBA{0x9e, 0xc9, 0xf0, 0xff}
+var mission_path_color = color.RGBA{0x1f, 0x5f, 0x9e, 0xff}
+var mission_start_color = color.RGBA{0x2e, 0xa0, 0x43, 0xff}
+var mission_end_color = color.RGBA{0xd6, 0x33, 0x33, 0xff}
+
+type MissionMap struct {
+	Id        string
+	Start     time.Time
+	End       time.Time
+	Initiator string
+	Points    []PosePoint
+}
+
+type MissionRecorder struct {
+	Folder  string
+	Retain  int
+	Current *MissionMap
+	mutex   sync.Mutex
+}
+
+func NewMissionRecorder(data_dir string, roomba_id string) *MissionRecorder {
+	return &MissionRecorder{
+		Folder: path.Join(data_dir, "missions", roomba_id),
+		Retain: MISSION_MAP_RETAIN,
+	}
+}
+
+func (self *MissionRecorder) StartMission(initiator string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	now := time.Now()
+	self.Current = &MissionMap{
+		Id:        now.UTC().Format("20060102T150405Z"),
+		Start:     now,
+		Initiator: initiator,
+	}
+	log.Info().Str("mission", self.Current.Id).Str("initiator", initiator).Msg("Mission started")
+}
+
+func (self *MissionRecorder) IsActive() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.Current != nil
+}
+
+func (self *MissionRecorder) AddPose(pose Pose) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.Current == nil {
+		return
+	}
+	points := self.Current.Points
+	if len(points) > 0 && points[len(points)-1] == pose.Point {
+		return
+	}
+	self.Current.Points = append(self.Current.Points, pose.Point)
+}
+
+// FinishMission close the current mission, save it to disk and return it.
+// nil is returned when no mission was in progress or when the robot did not
+// report any position, the mission is not saved.
+func (self *MissionRecorder) FinishMission() *MissionMap {
+	self.mutex.Lock()
+	mission := self.Current
+	self.Current = nil
+	self.mutex.Unlock()
+
+	if mission == nil {
+		return nil
+	}
+	mission.End = time.Now()
+	if len(mission.Points) == 0 {
+		log.Info().Str("mission", mission.Id).Msg("Mission without position not saved")
+		return nil
+	}
+	log.Info().Str("mission", mission.Id).Int("points", len(mission.Points)).Msg("Mission finished")
+
+	err := self.Save(mission)
+	if err != nil {
+		log.Error().Err(err).Str("mission", mission.Id).Msg("Saving mission map")
+	}
+	self.Prune()
+
+	return mission
+}
+
+// CurrentSnapshot return a copy of the mission in progress
+func (self *MissionRecorder) CurrentSnapshot() *MissionMap {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.Current == nil {
+		return nil
+	}
+	snapshot := *self.Current
+	snapshot.Points = append([]PosePoint{}, self.Current.Points...)
+	return &snapshot
+}
+
+func (self *MissionRecorder) Save(mission *MissionMap) error {
+	os.MkdirAll(self.Folder, 0755)
+
+	data, err := json.Marshal(mission)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path.Join(self.Folder, mission.Id+".json"), data, 0644)
+	if err != nil {
+		return err
+	}
+
+	data, err = mission.RenderPng()
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path.Join(self.Folder, mission.Id+".png"), data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(self.Folder, mission.Id+".svg"), mission.RenderSvg(), 0644)
+}
+
+// List return the id of the missions on disk, oldest first
+func (self *MissionRecorder) List() []string {
+	files, err := ioutil.ReadDir(self.Folder)
+	if err != nil {
+		return []string{}
+	}
+
+	return_value := []string{}
+	for i := range files {
+		name := files[i].Name()
+		if strings.HasSuffix(name, ".json") {
+			return_value = append(return_value, strings.TrimSuffix(name, ".json"))
+		}
+	}
+	sort.Strings(return_value)
+	return return_value
+}
+
+// Latest return the last finished mission saved on disk
+func (self *MissionRecorder) Latest() *MissionMap {
+	missions := self.List()
+	if len(missions) == 0 {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path.Join(self.Folder, missions[len(missions)-1]+".json"))
+	if err != nil {
+		log.Error().Err(err).Msg("Loading mission map")
+		return nil
+	}
+	mission := &MissionMap{}
+	err = json.Unmarshal(data, mission)
+	if err != nil {
+		log.Error().Err(err).Msg("Loading mission map")
+		return nil
+	}
+	return mission
+}
+
+func (self *MissionRecorder) Prune() {
+	if self.Retain <= 0 {
+		return
+	}
+	missions := self.List()
+	for len(missions) > self.Retain {
+		for _, ext := range []string{".json", ".png", ".svg"} {
+			os.Remove(path.Join(self.Folder, missions[0]+ext))
+		}
+		log.Info().Str("mission", missions[0]).Msg("Mission map removed")
+		missions = missions[1:]
+	}
+}
+
+// Read return the content of a rendered mission map, ext being "png" or "svg".
+// mission_id can be "latest" for the last finished mission or "current" for
+// the mission in progress.
+func (self *MissionRecorder) Read(mission_id string, ext string) ([]byte, error) {
+	if ext != "png" && ext != "svg" {
+		return nil, errors.New("unsupported format")
+	}
+
+	if mission_id == "current" {
+		mission := self.CurrentSnapshot()
+		if mission == nil {
+			return nil, os.ErrNotExist
+		}
+		if ext == "svg" {
+			return mission.RenderSvg(), nil
+		}
+		return mission.RenderPng()
+	}
+
+	if mission_id == "latest" {
+		missions := self.List()
+		if len(missions) == 0 {
+			return nil, os.ErrNotExist
+		}
+		mission_id = missions[len(missions)-1]
+	}
+	if strings.ContainsAny(mission_id, "/\\.") {
+		return nil, os.ErrNotExist
+	}
+
+	return ioutil.ReadFile(path.Join(self.Folder, mission_id+"."+ext))
+}
+
+type missionProjection struct {
+	min_x  float64
+	max_y  float64
+	scale  float64
+	width  int
+	height int
+}
+
+func (self *MissionMap) projection() missionProjection {
+	min_x, min_y := math.Inf(1), math.Inf(1)
+	max_x, max_y := math.Inf(-1), math.Inf(-1)
+	for i := range self.Points {
+		min_x = math.Min(min_x, float64(self.Points[i].X))
+		min_y = math.Min(min_y, float64(self.Points[i].Y))
+		max_x = math.Max(max_x, float64(self.Points[i].X))
+		max_y = math.Max(max_y, float64(self.Points[i].Y))
+	}
+	if len(self.Points) == 0 {
+		min_x, min_y, max_x, max_y = 0, 0, 0, 0
+	}
+	min_x -= mission_brush_size
+	min_y -= mission_brush_size
+	max_x += mission_brush_size
+	max_y += mission_brush_size
+
+	scale := (mission_map_size - 2*mission_map_margin) / math.Max(max_x-min_x, max_y-min_y)
+	return missionProjection{
+		min_x:  min_x,
+		max_y:  max_y,
+		scale:  scale,
+		width:  int(math.Ceil((max_x-min_x)*scale + 2*mission_map_margin)),
+		height: int(math.Ceil((max_y-min_y)*scale + 2*mission_map_margin)),
+	}
+}
+
+// Y axis is flipped so the map is drawn as seen from above
+func (self missionProjection) project(p PosePoint) (float64, float64) {
+	return (float64(p.X)-self.min_x)*self.scale + mission_map_margin,
+		(self.max_y-float64(p.Y))*self.scale + mission_map_margin
+}
+
+func fillDisk(img *image.RGBA, cx float64, cy float64, radius float64, c color.RGBA) {
+	bounds := img.Bounds()
+	for y := int(cy - radius); y <= int(cy+radius); y++ {
+		for x := int(cx - radius); x <= int(cx+radius); x++ {
+			dx := float64(x) - cx
+			dy := float64(y) - cy
+			if dx*dx+dy*dy <= radius*radius && image.Pt(x, y).In(bounds) {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+}
+
+func drawSegment(img *image.RGBA, x0 float64, y0 float64, x1 float64, y1 float64, radius float64, c color.RGBA) {
+	length := math.Hypot(x1-x0, y1-y0)
+	steps := int(math.Ceil(length))
+	if steps == 0 {
+		steps = 1
+	}
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		fillDisk(img, x0+(x1-x0)*t, y0+(y1-y0)*t, radius, c)
+	}
+}
+
+func (self *MissionMap) RenderPng() ([]byte, error) {
+	proj := self.projection()
+	img := image.NewRGBA(image.Rect(0, 0, proj.width, proj.height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(mission_background_color), image.Point{}, draw.Src)
+
+	brush := mission_brush_size * proj.scale / 2
+	for _, pass := range []struct {
+		radius float64
+		color  color.RGBA
+	}{
+		{brush, mission_coverage_color},
+		{1, mission_path_color},
+	} {
+		for i := range self.Points {
+			x1, y1 := proj.project(self.Points[i])
+			x0, y0 := x1, y1
+			if i > 0 {
+				x0, y0 = proj.project(self.Points[i-1])
+			}
+			drawSegment(img, x0, y0, x1, y1, pass.radius, pass.color)
+		}
+	}
+
+	if len(self.Points) > 0 {
+		x, y := proj.project(self.Points[0])
+		fillDisk(img, x, y, 5, mission_start_color)
+		x, y = proj.project(self.Points[len(self.Points)-1])
+		fillDisk(img, x, y, 5, mission_end_color)
+	}
+
+	buffer := bytes.Buffer{}
+	err := png.Encode(&buffer, img)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func svgColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func (self *MissionMap) RenderSvg() []byte {
+	proj := self.projection()
+
+	points := []string{}
+	for i := range self.Points {
+		x, y := proj.project(self.Points[i])
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+
+	buffer := bytes.Buffer{}
+	fmt.Fprintf(&buffer, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`,
+		proj.width, proj.height, proj.width, proj.height)
+	fmt.Fprintf(&buffer, `<rect width="100%%" height="100%%" fill="%s"/>`, svgColor(mission_background_color))
+	if len(points) > 0 {
+		fmt.Fprintf(&buffer, `<polyline points="%s" fill="none" stroke="%s" stroke-width="%.1f" stroke-linecap="round" stroke-linejoin="round"/>`,
+			strings.Join(points, " "), svgColor(mission_coverage_color), mission_brush_size*proj.scale)
+		fmt.Fprintf(&buffer, `<polyline points="%s" fill="none" stroke="%s" stroke-width="1"/>`,
+			strings.Join(points, " "), svgColor(mission_path_color))
+
+		x, y := proj.project(self.Points[0])
+		fmt.Fprintf(&buffer, `<circle cx="%.1f" cy="%.1f" r="5" fill="%s"/>`, x, y, svgColor(mission_start_color))
+		x, y = proj.project(self.Points[len(self.Points)-1])
+		fmt.Fprintf(&buffer, `<circle cx="%.1f" cy="%.1f" r="5" fill="%s"/>`, x, y, svgColor(mission_end_color))
+	}
+	buffer.WriteString(`</svg>`)
+
+	return buffer.Bytes()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestMissionCycles check that dock and evac cycles and missions without any
+// position do not save a mission map
+func TestMissionCycles(t *testing.T) {
+	DATA_FOLDER = t.TempDir()
+	DEBUG_FOLDER = ""
+	retained_registry = nil
+
+	topic := "$aws/things/" + test_blid + "/shadow/update"
+	report := func(cycle string, phase string, pose string) CapturedMessage {
+		payload := `{"state":{"reported":{"batPct":90,"cleanMissionStatus":{"cycle":"` + cycle + `","phase":"` + phase + `","initiator":"localApp"}` + pose + `}}}`
+		return CapturedMessage{Topic: topic, Payload: []byte(payload)}
+	}
+	pose := `,"pose":{"theta":0,"point":{"x":10,"y":20}}`
+	messages := []CapturedMessage{
+		{Topic: topic, Payload: []byte(`{"state":{"reported":{"name":"Test Roomba","sku":"i755020"}}}`)},
+		report("none", "charge", ""),
+		// docking and emptying the bin are not missions
+		report("dock", "hmUsrDock", pose),
+		report("none", "charge", ""),
+		report("evac", "evac", pose),
+		report("none", "charge", ""),
+		// a mission cancelled before the robot moved
+		report("clean", "run", ""),
+		report("none", "charge", ""),
+	}
+
+	master := NewFakeMqttClient()
+	master.Connect()
+	client, err := ReplayCapture(master, messages, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var missions []string
+	client.Loop.Call(func() {
+		missions = client.Missions.List()
+	})
+	if len(missions) != 0 {
+		t.Errorf("missions %v saved, want none", missions)
+	}
+
+	client, err = ReplayCapture(master, []CapturedMessage{
+		messages[0],
+		report("clean", "run", pose),
+		report("none", "charge", ""),
+	}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Loop.Call(func() {
+		missions = client.Missions.List()
+	})
+	if len(missions) != 1 {
+		t.Errorf("missions %v saved, want one", missions)
+	}
+}
@@ -3,13 +3,18 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/url"
+	"sync"
+	"time"
 
 	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/eclipse/paho.golang/paho"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog/log"
 )
 
 var cipher_suite []uint16 = []uint16{
@@ -19,56 +24,308 @@ var cipher_suite []uint16 = []uint16{
 	tls.TLS_RSA_WITH_RC4_128_SHA,
 }
 
+type MqttTlsConfig struct {
+	Enabled bool
+	// Legacy use the relaxed settings the robots need: no verification and
+	// the ciphers they support
+	Legacy             bool
+	CaFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+	MinVersion         uint16
+}
+
 type MqttConfig struct {
-	Broker   string
+	Broker string
+	// Url overrides Broker and Port, schemes are mqtt, mqtts, ws and wss
+	Url string
+	// Version is the MQTT protocol: 3 for 3.1, 4 for 3.1.1, 5 for 5 and 0 to
+	// let the v3 client pick 3.1.1 with fallback to 3.1
 	Version  int
 	Port     uint
 	Username string
 	Password string
+	// ClientId default to Username when empty
+	ClientId string
+	// KeepAlive in seconds, 0 use the library default
+	KeepAlive uint16
+	// CleanStart false resume the broker session, kept for SessionExpiry
+	// seconds after a disconnection (v5 only)
+	CleanStart    bool
+	SessionExpiry uint32
+	Tls           MqttTlsConfig
+}
+
+var mqtt_versions map[string]int = map[string]int{
+	"3":     3,
+	"3.1":   3,
+	"4":     4,
+	"3.1.1": 4,
+	"5":     5,
+	"5.0":   5,
+}
+
+func (self MqttConfig) clientId() string {
+	if self.ClientId != "" {
+		return self.ClientId
+	}
+	return self.Username
+}
+
+var tls_versions map[string]uint16 = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (self MqttTlsConfig) Build() (*tls.Config, error) {
+	if self.Legacy {
+		return &tls.Config{
+			CipherSuites:       cipher_suite,
+			InsecureSkipVerify: true,
+		}, nil
+	}
+
+	return_value := &tls.Config{
+		ServerName:         self.ServerName,
+		InsecureSkipVerify: self.InsecureSkipVerify,
+		MinVersion:         self.MinVersion,
+	}
+	if self.CaFile != "" {
+		data, err := ioutil.ReadFile(self.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		return_value.RootCAs = x509.NewCertPool()
+		if !return_value.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in %s", self.CaFile)
+		}
+	}
+	if self.CertFile != "" || self.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(self.CertFile, self.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return_value.Certificates = []tls.Certificate{cert}
+	}
+	return return_value, nil
+}
+
+// BrokerUrl return the URL of the broker, TLS is used when enabled or when the
+// URL scheme requires it
+func (self MqttConfig) BrokerUrl() (*url.URL, bool, error) {
+	broker_url := &url.URL{
+		Scheme: "mqtt",
+		Host:   fmt.Sprintf("%s:%d", self.Broker, self.Port),
+	}
+	if self.Url != "" {
+		var err error
+		broker_url, err = url.Parse(self.Url)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	use_tls := self.Tls.Enabled
+	switch broker_url.Scheme {
+	case "mqtt", "tcp":
+		if use_tls {
+			broker_url.Scheme = "mqtts"
+		}
+	case "mqtts", "ssl", "tls", "mqtt+ssl", "tcps", "wss":
+		use_tls = true
+	case "ws":
+		if use_tls {
+			broker_url.Scheme = "wss"
+		}
+	default:
+		return nil, false, fmt.Errorf("unsupported scheme %s", broker_url.Scheme)
+	}
+	return broker_url, use_tls, nil
 }
 
 type SubscribeHandleFunction func(topic string, payload []byte)
 
+// How long Connect wait for the broker before giving up
+const connect_timeout = 30 * time.Second
+
+// How long Disconnect wait for the in flight messages when the context has
+// no deadline
+const disconnect_quiesce = 250 * time.Millisecond
+
 type MqttClient interface {
 	Connect() error
+	Disconnect(ctx context.Context) error
+	IsConnected() bool
 	Publish(topic string, payload []byte, qos uint8, retain bool) error
 	Subscribe(topic string, fnc SubscribeHandleFunction) error
+	// Unsubscribe remove every handler of the topic filter
+	Unsubscribe(topic string) error
+	// OnConnectionUp is called on each connection, including reconnections
+	OnConnectionUp(fnc func())
+	// OnConnectionLost is called when an established connection drops, the
+	// client reconnects by itself
+	OnConnectionLost(fnc func(err error))
 }
 
 type MqttClientv5 struct {
-	cm      *autopaho.ConnectionManager
-	cfg     autopaho.ClientConfig
-	fnc_map map[string]SubscribeHandleFunction
+	cm                 *autopaho.ConnectionManager
+	cancel             context.CancelFunc
+	cfg                autopaho.ClientConfig
+	router             TopicRouter
+	connected          bool
+	on_connection_up   func()
+	on_connection_lost func(err error)
+	mutex              sync.Mutex
 }
 
 type MqttClientv4 struct {
-	client mqtt.Client
-	opts   *mqtt.ClientOptions
+	client             mqtt.Client
+	opts               *mqtt.ClientOptions
+	router             TopicRouter
+	on_connection_up   func()
+	on_connection_lost func(err error)
+	mutex              sync.Mutex
 }
 
 func (self *MqttClientv5) message_handler(m *paho.Publish) {
-	if _, ok := self.fnc_map[m.Topic]; ok {
-		self.fnc_map[m.Topic](m.Topic, m.Payload)
+	if !self.router.Route(m.Topic, m.Payload) {
+		log.Debug().Str("topic", m.Topic).Msg("MQTT message without handler")
 	}
 }
 
+func (self *MqttClientv5) subscribe(cm *autopaho.ConnectionManager, topic string) error {
+	sub := paho.Subscribe{
+		Properties: &paho.SubscribeProperties{},
+		Subscriptions: map[string]paho.SubscribeOptions{
+			topic: {
+				NoLocal: true,
+			},
+		},
+	}
+
+	_, err := cm.Subscribe(context.Background(), &sub)
+	return err
+}
+
+// connection_up restore the subscriptions, autopaho does not keep them
+// across reconnections. On the first connection it runs before Connect
+// return, the connection manager is set for the callback to publish.
+func (self *MqttClientv5) connection_up(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+	topics := self.router.Filters()
+	self.mutex.Lock()
+	self.cm = cm
+	self.connected = true
+	on_connection_up := self.on_connection_up
+	self.mutex.Unlock()
+
+	for i := range topics {
+		err := self.subscribe(cm, topics[i])
+		if err != nil {
+			log.Error().Err(err).Str("topic", topics[i]).Msg("MQTT subscribe")
+		}
+	}
+
+	if on_connection_up != nil {
+		on_connection_up()
+	}
+}
+
+// connection_lost is called by paho on client errors and server
+// disconnections, only the first one of a connection is reported
+func (self *MqttClientv5) connection_lost(err error) {
+	self.mutex.Lock()
+	was_connected := self.connected
+	self.connected = false
+	on_connection_lost := self.on_connection_lost
+	self.mutex.Unlock()
+
+	if was_connected && on_connection_lost != nil {
+		on_connection_lost(err)
+	}
+}
+
+func (self *MqttClientv5) OnConnectionUp(fnc func()) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.on_connection_up = fnc
+}
+
+func (self *MqttClientv5) OnConnectionLost(fnc func(err error)) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.on_connection_lost = fnc
+}
+
+func (self *MqttClientv5) IsConnected() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.cm != nil && self.connected
+}
+
+// Disconnect stop the connection manager and release its context, Connect
+// can be called again after
+func (self *MqttClientv5) Disconnect(ctx context.Context) error {
+	self.mutex.Lock()
+	cm, cancel := self.cm, self.cancel
+	self.cm, self.cancel = nil, nil
+	self.connected = false
+	self.mutex.Unlock()
+
+	if cm == nil {
+		return nil
+	}
+	err := cm.Disconnect(ctx)
+	if cancel != nil {
+		cancel()
+	}
+	return err
+}
+
 func (self *MqttClientv5) Connect() error {
-	var err error
-	self.cm, err = autopaho.NewConnection(context.Background(), self.cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	cm, err := autopaho.NewConnection(ctx, self.cfg)
 	if err != nil {
+		cancel()
 		return err
 	}
 
-	err = self.cm.AwaitConnection(context.Background())
+	await_ctx, await_cancel := context.WithTimeout(ctx, connect_timeout)
+	defer await_cancel()
+	err = cm.AwaitConnection(await_ctx)
 	if err != nil {
+		cancel()
+		self.mutex.Lock()
+		self.cm = nil
+		self.connected = false
+		self.mutex.Unlock()
 		return err
 	}
 
+	self.mutex.Lock()
+	self.cm = cm
+	self.cancel = cancel
+	self.mutex.Unlock()
+
 	return nil
 }
 
 func (self *MqttClientv5) Publish(topic string, payload []byte, qos uint8, retain bool) error {
-	_, err := self.cm.Publish(context.Background(), &paho.Publish{
+	self.mutex.Lock()
+	cm := self.cm
+	self.mutex.Unlock()
+
+	if cm == nil {
+		return errors.New("not connected")
+	}
+
+	_, err := cm.Publish(context.Background(), &paho.Publish{
 		Topic:   topic,
 		Payload: payload,
 		Retain:  retain,
@@ -77,55 +334,92 @@ func (self *MqttClientv5) Publish(topic string, payload []byte, qos uint8, retai
 	return err
 }
 
+// Subscribe register the handler, a new filter is sent to the broker now if
+// connected or when the connection comes up
 func (self *MqttClientv5) Subscribe(topic string, fnc SubscribeHandleFunction) error {
-	if self.fnc_map == nil {
-		self.fnc_map = map[string]SubscribeHandleFunction{}
+	if !self.router.Add(topic, fnc) {
+		return nil
 	}
 
-	if _, ok := self.fnc_map[topic]; ok {
-		return errors.New("topic already subscribed")
-	}
+	self.mutex.Lock()
+	cm := self.cm
+	self.mutex.Unlock()
 
-	self.fnc_map[topic] = fnc
+	if cm == nil {
+		return nil
+	}
+	return self.subscribe(cm, topic)
+}
 
-	sub := paho.Subscribe{
-		Properties: &paho.SubscribeProperties{},
-		Subscriptions: map[string]paho.SubscribeOptions{
-			topic: {
-				NoLocal: true,
-			},
-		},
+func (self *MqttClientv5) Unsubscribe(topic string) error {
+	if !self.router.Remove(topic) {
+		return nil
 	}
 
-	self.cm.Subscribe(context.Background(), &sub)
+	self.mutex.Lock()
+	cm := self.cm
+	self.mutex.Unlock()
 
-	return nil
+	if cm == nil {
+		return nil
+	}
+	_, err := cm.Unsubscribe(context.Background(), &paho.Unsubscribe{
+		Topics: []string{topic},
+	})
+	return err
 }
 
 func Connect5(config MqttConfig) (*MqttClientv5, error) {
 	return_value := &MqttClientv5{}
 
-	schema := "mqtt"
-	if config.Port == 8883 {
-		schema = "ssl"
+	broker_url, use_tls, err := config.BrokerUrl()
+	if err != nil {
+		return nil, err
 	}
 	return_value.cfg = autopaho.ClientConfig{
 		BrokerUrls: []*url.URL{
-			{
-				Scheme: schema,
-				Host:   fmt.Sprintf("%s:%d", config.Broker, config.Port),
-			},
+			broker_url,
 		},
 
-		ClientConfig: paho.ClientConfig{
-			ClientID: config.Username,
-			Router:   paho.NewSingleHandlerRouter(return_value.message_handler),
+		OnConnectionUp: return_value.connection_up,
+		OnConnectError: func(err error) {
+			log.Warn().Err(err).Str("broker", config.Broker).Msg("MQTT connection attempt")
 		},
-		TlsCfg: &tls.Config{
-			CipherSuites:       cipher_suite,
-			InsecureSkipVerify: true,
+
+		KeepAlive: config.KeepAlive,
+
+		ClientConfig: paho.ClientConfig{
+			ClientID:      config.clientId(),
+			Router:        paho.NewSingleHandlerRouter(return_value.message_handler),
+			OnClientError: return_value.connection_lost,
+			OnServerDisconnect: func(disconnect *paho.Disconnect) {
+				return_value.connection_lost(fmt.Errorf("server disconnect, reason code %d", disconnect.ReasonCode))
+			},
 		},
 	}
+	if config.KeepAlive == 0 {
+		return_value.cfg.KeepAlive = 30
+	}
+	if config.Username != "" {
+		return_value.cfg.SetUsernamePassword(config.Username, []byte(config.Password))
+	}
+	return_value.cfg.SetConnectPacketConfigurator(func(connect *paho.Connect) *paho.Connect {
+		connect.CleanStart = config.CleanStart
+		if config.SessionExpiry > 0 {
+			if connect.Properties == nil {
+				connect.Properties = &paho.ConnectProperties{}
+			}
+			session_expiry := config.SessionExpiry
+			connect.Properties.SessionExpiryInterval = &session_expiry
+		}
+		return connect
+	})
+	if use_tls {
+		return_value.cfg.TlsCfg, err = config.Tls.Build()
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return return_value, nil
 }
@@ -146,36 +440,133 @@ func (self *MqttClientv4) Publish(topic string, payload []byte, qos uint8, retai
 	return token.Error()
 }
 
+// message_handler is the default publish handler, the subscriptions have no
+// callback so every message goes through the shared router
+func (self *MqttClientv4) message_handler(client mqtt.Client, msg mqtt.Message) {
+	if !self.router.Route(msg.Topic(), msg.Payload()) {
+		log.Debug().Str("topic", msg.Topic()).Msg("MQTT message without handler")
+	}
+}
+
+func (self *MqttClientv4) subscribe(topic string) error {
+	token := self.client.Subscribe(topic, 0, nil)
+	token.Wait()
+	return token.Error()
+}
+
+// Subscribe register the handler, a new filter is sent to the broker now if
+// connected and again on each reconnection
 func (self *MqttClientv4) Subscribe(topic string, fnc SubscribeHandleFunction) error {
-	token := self.client.Subscribe(topic, 0, func(client mqtt.Client, msg mqtt.Message) {
-		fnc(msg.Topic(), msg.Payload())
-	})
+	if !self.router.Add(topic, fnc) {
+		return nil
+	}
+
+	if !self.client.IsConnectionOpen() {
+		return nil
+	}
+	return self.subscribe(topic)
+}
+
+func (self *MqttClientv4) Unsubscribe(topic string) error {
+	if !self.router.Remove(topic) || !self.client.IsConnectionOpen() {
+		return nil
+	}
+	token := self.client.Unsubscribe(topic)
+	token.Wait()
 	return token.Error()
 }
 
+func (self *MqttClientv4) IsConnected() bool {
+	return self.client.IsConnectionOpen()
+}
+
+// Disconnect close the connection, the in flight messages have until the
+// context deadline to be sent
+func (self *MqttClientv4) Disconnect(ctx context.Context) error {
+	quiesce := disconnect_quiesce
+	if deadline, ok := ctx.Deadline(); ok {
+		quiesce = time.Until(deadline)
+	}
+	if quiesce < 0 {
+		quiesce = 0
+	}
+	self.client.Disconnect(uint(quiesce.Milliseconds()))
+	return nil
+}
+
+func (self *MqttClientv4) connection_up(client mqtt.Client) {
+	topics := self.router.Filters()
+	self.mutex.Lock()
+	on_connection_up := self.on_connection_up
+	self.mutex.Unlock()
+
+	for _, topic := range topics {
+		err := self.subscribe(topic)
+		if err != nil {
+			log.Error().Err(err).Str("topic", topic).Msg("MQTT subscribe")
+		}
+	}
+
+	if on_connection_up != nil {
+		on_connection_up()
+	}
+}
+
+func (self *MqttClientv4) OnConnectionUp(fnc func()) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.on_connection_up = fnc
+}
+
+func (self *MqttClientv4) connection_lost(client mqtt.Client, err error) {
+	self.mutex.Lock()
+	on_connection_lost := self.on_connection_lost
+	self.mutex.Unlock()
+
+	if on_connection_lost != nil {
+		on_connection_lost(err)
+	}
+}
+
+func (self *MqttClientv4) OnConnectionLost(fnc func(err error)) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.on_connection_lost = fnc
+}
+
 func Connect34(config MqttConfig) (*MqttClientv4, error) {
 	return_value := &MqttClientv4{}
 
 	return_value.opts = mqtt.NewClientOptions()
-	schema := "tcp"
-	if config.Port == 8883 {
-		schema = "ssl"
+	broker_url, use_tls, err := config.BrokerUrl()
+	if err != nil {
+		return nil, err
 	}
-	return_value.opts.AddBroker(fmt.Sprintf("%s://%s:%d", schema, config.Broker, config.Port))
-	return_value.opts.SetClientID(config.Username)
+	return_value.opts.AddBroker(broker_url.String())
+	return_value.opts.SetClientID(config.clientId())
 	return_value.opts.SetUsername(config.Username)
 	return_value.opts.SetPassword(config.Password)
 	return_value.opts.SetProtocolVersion(uint(config.Version))
 	return_value.opts.SetAutoReconnect(true)
+	return_value.opts.SetCleanSession(config.CleanStart)
+	if config.KeepAlive > 0 {
+		return_value.opts.SetKeepAlive(time.Duration(config.KeepAlive) * time.Second)
+	}
 
-	if config.Port == 8883 {
-		tlsConfig := tls.Config{}
-		tlsConfig.CipherSuites = cipher_suite
-		tlsConfig.InsecureSkipVerify = true
-		return_value.opts.SetTLSConfig(&tlsConfig)
+	if use_tls {
+		tlsConfig, err := config.Tls.Build()
+		if err != nil {
+			return nil, err
+		}
+		return_value.opts.SetTLSConfig(tlsConfig)
 	}
 
 	return_value.opts.AutoReconnect = true
+	return_value.opts.SetOnConnectHandler(return_value.connection_up)
+	return_value.opts.SetDefaultPublishHandler(return_value.message_handler)
+	return_value.opts.SetConnectionLostHandler(return_value.connection_lost)
 
 	return_value.client = mqtt.NewClient(return_value.opts)
 
@@ -183,9 +574,11 @@ func Connect34(config MqttConfig) (*MqttClientv4, error) {
 }
 
 func NewMqttClient(config MqttConfig) (MqttClient, error) {
-	if config.Version >= 5 {
+	switch config.Version {
+	case 5:
 		return Connect5(config)
-	} else {
+	case 0, 3, 4:
 		return Connect34(config)
 	}
+	return nil, fmt.Errorf("unsupported MQTT version %d", config.Version)
 }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/rs/zerolog/log"
+)
+
+// MqttBroker is a minimal MQTT 3.1.1 broker used by the simulator, for the
+// robot endpoint and as embedded master broker. Messages are delivered with
+// QoS 0, QoS 1 and 2 publishes are acknowledged.
+type MqttBroker struct {
+	Name string
+	// Authenticate accept every client when nil
+	Authenticate func(client_id string, username string, password []byte) bool
+	// OnPublish is called for every message published by a client
+	OnPublish func(topic string, payload []byte)
+	// OnSubscribe is called after a client subscribed
+	OnSubscribe func(filters []string)
+	retained    map[string][]byte
+	sessions    map[*brokerSession]bool
+	mutex       sync.Mutex
+}
+
+type brokerSession struct {
+	conn      net.Conn
+	client_id string
+	filters   []string
+	mutex     sync.Mutex
+}
+
+func NewMqttBroker(name string) *MqttBroker {
+	return &MqttBroker{
+		Name:     name,
+		retained: map[string][]byte{},
+		sessions: map[*brokerSession]bool{},
+	}
+}
+
+// Serve accept connections until the listener is closed
+func (self *MqttBroker) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go self.handle(conn)
+	}
+}
+
+func (self *brokerSession) write(packet packets.ControlPacket) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return packet.Write(self.conn)
+}
+
+func (self *brokerSession) subscribed(topic string) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i := range self.filters {
+		if TopicMatch(self.filters[i], topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *brokerSession) deliver(topic string, payload []byte, retain bool) {
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = topic
+	publish.Payload = payload
+	publish.Retain = retain
+	err := self.write(publish)
+	if err != nil {
+		log.Debug().Err(err).Str("client_id", self.client_id).Msg("MQTT broker deliver")
+	}
+}
+
+// Publish deliver a message to the subscribed clients
+func (self *MqttBroker) Publish(topic string, payload []byte, retain bool) {
+	self.mutex.Lock()
+	if retain {
+		if len(payload) == 0 {
+			delete(self.retained, topic)
+		} else {
+			self.retained[topic] = payload
+		}
+	}
+	sessions := []*brokerSession{}
+	for session := range self.sessions {
+		sessions = append(sessions, session)
+	}
+	self.mutex.Unlock()
+
+	for i := range sessions {
+		if sessions[i].subscribed(topic) {
+			sessions[i].deliver(topic, payload, false)
+		}
+	}
+}
+
+func (self *MqttBroker) connect(conn net.Conn) (*brokerSession, uint16) {
+	conn.SetReadDeadline(time.Now().Add(connect_timeout))
+	packet, err := packets.ReadPacket(conn)
+	if err != nil {
+		return nil, 0
+	}
+	connect, ok := packet.(*packets.ConnectPacket)
+	if !ok {
+		return nil, 0
+	}
+
+	session := &brokerSession{conn: conn, client_id: connect.ClientIdentifier}
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = connect.Validate()
+	if connack.ReturnCode == packets.Accepted && self.Authenticate != nil &&
+		!self.Authenticate(connect.ClientIdentifier, connect.Username, connect.Password) {
+		connack.ReturnCode = packets.ErrRefusedBadUsernameOrPassword
+	}
+	session.write(connack)
+	if connack.ReturnCode != packets.Accepted {
+		log.Warn().Str("broker", self.Name).Str("client_id", connect.ClientIdentifier).Uint8("return_code", connack.ReturnCode).Msg("MQTT broker connection refused")
+		return nil, 0
+	}
+	return session, connect.Keepalive
+}
+
+func (self *MqttBroker) handle(conn net.Conn) {
+	defer conn.Close()
+
+	session, keepalive := self.connect(conn)
+	if session == nil {
+		return
+	}
+	log.Info().Str("broker", self.Name).Str("client_id", session.client_id).Msg("MQTT broker client connected")
+
+	self.mutex.Lock()
+	self.sessions[session] = true
+	self.mutex.Unlock()
+	defer func() {
+		self.mutex.Lock()
+		delete(self.sessions, session)
+		self.mutex.Unlock()
+		log.Info().Str("broker", self.Name).Str("client_id", session.client_id).Msg("MQTT broker client disconnected")
+	}()
+
+	for {
+		if keepalive > 0 {
+			conn.SetReadDeadline(time.Now().Add(time.Duration(keepalive) * 3 / 2 * time.Second))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		switch p := packet.(type) {
+		case *packets.SubscribePacket:
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = p.MessageID
+			session.mutex.Lock()
+			for i := range p.Topics {
+				session.filters = append(session.filters, p.Topics[i])
+				suback.ReturnCodes = append(suback.ReturnCodes, 0)
+			}
+			session.mutex.Unlock()
+			session.write(suback)
+			self.sendRetained(session, p.Topics)
+			if self.OnSubscribe != nil {
+				self.OnSubscribe(p.Topics)
+			}
+		case *packets.UnsubscribePacket:
+			session.mutex.Lock()
+			filters := []string{}
+			for i := range session.filters {
+				if !containsString(p.Topics, session.filters[i]) {
+					filters = append(filters, session.filters[i])
+				}
+			}
+			session.filters = filters
+			session.mutex.Unlock()
+			unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			unsuback.MessageID = p.MessageID
+			session.write(unsuback)
+		case *packets.PublishPacket:
+			switch p.Qos {
+			case 1:
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = p.MessageID
+				session.write(puback)
+			case 2:
+				pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				pubrec.MessageID = p.MessageID
+				session.write(pubrec)
+			}
+			if self.OnPublish != nil {
+				self.OnPublish(p.TopicName, p.Payload)
+			}
+			self.Publish(p.TopicName, p.Payload, p.Retain)
+		case *packets.PubrelPacket:
+			pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			pubcomp.MessageID = p.MessageID
+			session.write(pubcomp)
+		case *packets.PingreqPacket:
+			session.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func (self *MqttBroker) sendRetained(session *brokerSession, filters []string) {
+	self.mutex.Lock()
+	retained := map[string][]byte{}
+	for topic, payload := range self.retained {
+		for i := range filters {
+			if TopicMatch(filters[i], topic) {
+				retained[topic] = payload
+			}
+		}
+	}
+	self.mutex.Unlock()
+
+	for topic, payload := range retained {
+		session.deliver(topic, payload, true)
+	}
+}
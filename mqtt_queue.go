@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Number of messages kept while the master broker is unreachable, 0 disable
+// the queue
+var MQTT_QUEUE_SIZE = 1000
+
+// Delay before sending the queue again after a publish error while the
+// client is connected
+var MQTT_QUEUE_RETRY = 5 * time.Second
+
+var master_mqtt_queue *QueuedMqttClient
+
+var metric_publish_dropped = &CounterVec{
+	Name: "roomba2mqtt_publish_queue_dropped_total",
+	Help: "Queued messages dropped because the queue was full.",
+}
+
+type queuedMessage struct {
+	topic   string
+	payload []byte
+	qos     uint8
+	retain  bool
+}
+
+// QueuedMqttClient keep the messages that could not be published and send
+// them again when the connection comes back. For a retained topic only the
+// latest message is kept. Publish still return the error so the callers know
+// the message was not delivered yet. The queue is sent again on each
+// connection, and after Retry when a publish fail on a live connection.
+// While the queue is not empty the messages go through it, so an older
+// retained value is never sent after a newer one.
+type QueuedMqttClient struct {
+	MqttClient
+	Size             int
+	Retry            time.Duration
+	queue            []queuedMessage
+	draining         bool
+	unqueued         map[string]bool
+	retry_timer      *time.Timer
+	on_connection_up func()
+	mutex            sync.Mutex
+}
+
+func NewQueuedMqttClient(client MqttClient, size int) *QueuedMqttClient {
+	return_value := &QueuedMqttClient{
+		MqttClient: client,
+		Size:       size,
+		Retry:      MQTT_QUEUE_RETRY,
+		unqueued:   map[string]bool{},
+	}
+	client.OnConnectionUp(return_value.connection_up)
+	return return_value
+}
+
+// SetUnqueued mark a topic whose non retained messages are dropped instead
+// of queued, events are stale once the connection comes back. The queue may
+// be nil.
+func (self *QueuedMqttClient) SetUnqueued(topic string, unqueued bool) {
+	if self == nil || topic == "" {
+		return
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if unqueued {
+		self.unqueued[topic] = true
+	} else {
+		delete(self.unqueued, topic)
+	}
+}
+
+// evict make room in a full queue, the oldest non retained message goes
+// first as the retained ones are the state of the entities
+func (self *QueuedMqttClient) evict() {
+	if len(self.queue) == 0 {
+		return
+	}
+	index := 0
+	for i := range self.queue {
+		if !self.queue[i].retain {
+			index = i
+			break
+		}
+	}
+	log.Warn().Str("topic", self.queue[index].topic).Msg("MQTT queue full, dropping a message")
+	self.queue = append(self.queue[:index], self.queue[index+1:]...)
+	metric_publish_dropped.Inc()
+}
+
+// forget remove the queued messages of a retained topic
+func (self *QueuedMqttClient) forget(topic string) {
+	for i := range self.queue {
+		if self.queue[i].retain && self.queue[i].topic == topic {
+			self.queue = append(self.queue[:i], self.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+func (self *QueuedMqttClient) enqueue(message queuedMessage) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.Size <= 0 {
+		metric_publish_dropped.Inc()
+		return
+	}
+	if message.retain {
+		self.forget(message.topic)
+	}
+	if len(self.queue) >= self.Size {
+		self.evict()
+	}
+	self.queue = append(self.queue, message)
+}
+
+func (self *QueuedMqttClient) Publish(topic string, payload []byte, qos uint8, retain bool) error {
+	message := queuedMessage{topic: topic, payload: payload, qos: qos, retain: retain}
+	self.mutex.Lock()
+	unqueued := !retain && self.unqueued[topic]
+	pending := len(self.queue) > 0 || self.draining
+	self.mutex.Unlock()
+
+	if !self.MqttClient.IsConnected() {
+		if unqueued {
+			return errors.New("not connected, message dropped")
+		}
+		self.enqueue(message)
+		self.scheduleDrain()
+		return fmt.Errorf("not connected, message queued")
+	}
+	if pending && !unqueued {
+		self.enqueue(message)
+		self.scheduleDrain()
+		return fmt.Errorf("queue not sent yet, message queued")
+	}
+
+	err := self.MqttClient.Publish(topic, payload, qos, retain)
+	if err != nil && unqueued {
+		return fmt.Errorf("message dropped: %w", err)
+	}
+	if err != nil {
+		self.enqueue(message)
+		self.scheduleDrain()
+		return fmt.Errorf("message queued: %w", err)
+	}
+	if retain {
+		// a message queued by a concurrent publish is older
+		self.mutex.Lock()
+		self.forget(topic)
+		self.mutex.Unlock()
+	}
+	return nil
+}
+
+// scheduleDrain send the queue again after Retry, connection_up drain it
+// when the connection is lost meanwhile
+func (self *QueuedMqttClient) scheduleDrain() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.retry_timer != nil || self.draining || self.Retry <= 0 || len(self.queue) == 0 {
+		return
+	}
+	self.retry_timer = time.AfterFunc(self.Retry, func() {
+		self.mutex.Lock()
+		self.retry_timer = nil
+		self.mutex.Unlock()
+
+		if self.MqttClient.IsConnected() {
+			self.Drain()
+		}
+	})
+}
+
+func (self *QueuedMqttClient) Len() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return len(self.queue)
+}
+
+// Drain publish the queued messages in order, the messages queued meanwhile
+// included. It stops at the first error and keep the remaining ones for the
+// next try.
+func (self *QueuedMqttClient) Drain() {
+	self.mutex.Lock()
+	if self.draining {
+		self.mutex.Unlock()
+		return
+	}
+	self.draining = true
+	count := len(self.queue)
+	self.mutex.Unlock()
+
+	if count > 0 {
+		log.Info().Int("count", count).Msg("Sending queued MQTT messages")
+	}
+	for {
+		self.mutex.Lock()
+		if len(self.queue) == 0 {
+			self.draining = false
+			self.mutex.Unlock()
+			return
+		}
+		message := self.queue[0]
+		self.queue = self.queue[1:]
+		self.mutex.Unlock()
+
+		err := self.MqttClient.Publish(message.topic, message.payload, message.qos, message.retain)
+		if err != nil {
+			log.Error().Err(err).Str("topic", message.topic).Msg("Sending queued MQTT message")
+			self.requeue(message)
+			self.mutex.Lock()
+			self.draining = false
+			self.mutex.Unlock()
+			self.scheduleDrain()
+			return
+		}
+	}
+}
+
+// requeue put back a message in front of the queue unless a newer message
+// for the same retained topic was queued meanwhile
+func (self *QueuedMqttClient) requeue(message queuedMessage) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if message.retain {
+		for i := range self.queue {
+			if self.queue[i].retain && self.queue[i].topic == message.topic {
+				return
+			}
+		}
+	}
+	if self.Size <= 0 {
+		metric_publish_dropped.Inc()
+		return
+	}
+	if len(self.queue) >= self.Size {
+		self.evict()
+	}
+	self.queue = append([]queuedMessage{message}, self.queue...)
+}
+
+func (self *QueuedMqttClient) connection_up() {
+	self.Drain()
+
+	self.mutex.Lock()
+	on_connection_up := self.on_connection_up
+	self.mutex.Unlock()
+
+	if on_connection_up != nil {
+		on_connection_up()
+	}
+}
+
+func (self *QueuedMqttClient) OnConnectionUp(fnc func()) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.on_connection_up = fnc
+}
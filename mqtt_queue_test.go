@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestQueueRetry check that messages queued on a publish error are sent
+// again while the connection stays up
+func TestQueueRetry(t *testing.T) {
+	fake := NewFakeMqttClient()
+	fake.Connect()
+	queue := NewQueuedMqttClient(fake, 10)
+	queue.Retry = 20 * time.Millisecond
+
+	setPublishError := func(err error) {
+		fake.mutex.Lock()
+		fake.PublishError = err
+		fake.mutex.Unlock()
+	}
+
+	setPublishError(errors.New("timeout"))
+	if queue.Publish("a", []byte("1"), 0, true) == nil {
+		t.Fatal("publish error not returned")
+	}
+	queue.Publish("b", []byte("2"), 0, false)
+	if queue.Len() != 2 {
+		t.Fatalf("%d queued messages, want 2", queue.Len())
+	}
+
+	// the first retry fails too and schedule another one
+	time.Sleep(50 * time.Millisecond)
+	if queue.Len() != 2 {
+		t.Fatalf("%d queued messages after a failed retry, want 2", queue.Len())
+	}
+	setPublishError(nil)
+
+	deadline := time.Now().Add(time.Second)
+	for queue.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	messages := fake.Messages()
+	if queue.Len() != 0 || len(messages) != 2 || messages[0].Topic != "a" || messages[1].Topic != "b" {
+		t.Errorf("queue %d, published %v", queue.Len(), messages)
+	}
+}
+
+// TestQueueDrainOnConnection check that the queue is sent in order when the
+// connection comes back, a full queue drop the non retained messages first
+// and the events are not queued
+func TestQueueDrainOnConnection(t *testing.T) {
+	fake := NewFakeMqttClient()
+	queue := NewQueuedMqttClient(fake, 3)
+	queue.SetUnqueued("event", true)
+	queue.Publish("a", []byte("1"), 0, true)
+	queue.Publish("a", []byte("2"), 0, true)
+	queue.Publish("b", []byte("3"), 0, false)
+	queue.Publish("event", []byte("4"), 0, false)
+	queue.Publish("c", []byte("5"), 0, true)
+	queue.Publish("d", []byte("6"), 0, false)
+	queue.Publish("e", []byte("7"), 0, true)
+
+	fake.Connect()
+	topics := []string{}
+	for _, message := range fake.Messages() {
+		topics = append(topics, message.Topic+"="+string(message.Payload))
+	}
+	want := []string{"a=2", "c=5", "e=7"}
+	if queue.Len() != 0 || !reflect.DeepEqual(topics, want) {
+		t.Errorf("queue %d, published %v, want %v", queue.Len(), topics, want)
+	}
+}
+
+// TestQueueLatestRetained check that a queued retained value is never sent
+// after a newer one
+func TestQueueLatestRetained(t *testing.T) {
+	fake := NewFakeMqttClient()
+	fake.Connect()
+	queue := NewQueuedMqttClient(fake, 10)
+	queue.Retry = 20 * time.Millisecond
+
+	fake.mutex.Lock()
+	fake.PublishError = errors.New("timeout")
+	fake.mutex.Unlock()
+	queue.Publish("a", []byte("old"), 0, true)
+	fake.mutex.Lock()
+	fake.PublishError = nil
+	fake.mutex.Unlock()
+
+	// the newer value goes through the queue while it is not empty
+	queue.Publish("a", []byte("new"), 0, true)
+	deadline := time.Now().Add(time.Second)
+	for queue.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	messages := fake.Messages()
+	if len(messages) != 1 || string(messages[0].Payload) != "new" {
+		t.Errorf("published %v, want only the new value", messages)
+	}
+
+	// the drain of a reconnection keep the order
+	fake.Drop(errors.New("lost"))
+	queue.Publish("a", []byte("queued"), 0, true)
+	fake.Connect()
+	queue.Publish("a", []byte("latest"), 0, true)
+	if string(fake.Retained["a"]) != "latest" {
+		t.Errorf("retained %s, want latest", fake.Retained["a"])
+	}
+}
+
+// TestQueueTriggerEvents check that the robot events are dropped while the
+// master broker is unreachable
+func TestQueueTriggerEvents(t *testing.T) {
+	fake := NewFakeMqttClient()
+	master_mqtt_queue = NewQueuedMqttClient(fake, 10)
+	t.Cleanup(func() { master_mqtt_queue = nil })
+
+	home_assistant := ConfigureHomeAssistant(HA_DISCOVERY_PREFIX, master_mqtt_topic, master_mqtt_queue)
+	home_assistant.ConfigureTriggers(test_blid, &Device{})
+	home_assistant.SetRobotId(test_blid)
+	// the configs are retained and queued
+	queued := master_mqtt_queue.Len()
+	home_assistant.Triggers["docked"].Fire()
+	if master_mqtt_queue.Len() != queued {
+		t.Errorf("%d queued messages, want the event dropped", master_mqtt_queue.Len()-queued)
+	}
+
+	fake.Connect()
+	home_assistant.Triggers["docked"].Fire()
+	for _, message := range fake.Messages() {
+		if message.Topic == home_assistant.Triggers["docked"].Config.Topic {
+			return
+		}
+	}
+	t.Error("event not published once connected")
+}
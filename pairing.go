@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+const pairing_timeout = 10 * time.Second
+
+// Magic packet asking the robot for its local MQTT password. The robot only
+// answer when it is on its dock and the home button was held for 2 seconds.
+var password_request []byte = []byte{0xf0, 0x05, 0xef, 0xcc, 0x3b, 0x29, 0x00}
+
+type RobotDiscovery struct {
+	Version   string `json:"ver"`
+	Hostname  string `json:"hostname"`
+	RobotName string `json:"robotname"`
+	Ip        string `json:"ip"`
+	Mac       string `json:"mac"`
+	Sw        string `json:"sw"`
+	Sku       string `json:"sku"`
+	Proto     string `json:"proto"`
+	Blid      string `json:"-"`
+}
+
+// DiscoverRobot query a robot on the UDP discovery port to learn its blid
+func DiscoverRobot(address string) (RobotDiscovery, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(address, "5678"))
+	if err != nil {
+		return RobotDiscovery{}, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(pairing_timeout))
+	_, err = conn.Write([]byte("irobotmcs"))
+	if err != nil {
+		return RobotDiscovery{}, err
+	}
+
+	buffer := make([]byte, 4096)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return RobotDiscovery{}, err
+	}
+
+	return_value := RobotDiscovery{}
+	err = json.Unmarshal(buffer[:n], &return_value)
+	if err != nil {
+		return RobotDiscovery{}, err
+	}
+	if idx := strings.Index(return_value.Hostname, "-"); idx >= 0 {
+		return_value.Blid = return_value.Hostname[idx+1:]
+	}
+	return return_value, nil
+}
+
+// GetRobotPassword retrieve the local MQTT password of the robot
+func GetRobotPassword(address string) (string, error) {
+	dialer := &net.Dialer{Timeout: pairing_timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(address, "8883"), &tls.Config{
+		CipherSuites:       cipher_suite,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(pairing_timeout))
+	_, err = conn.Write(password_request)
+	if err != nil {
+		return "", err
+	}
+
+	// Response is f0 <length> ef cc 3b 29 00 <password>
+	data := []byte{}
+	buffer := make([]byte, 1024)
+	for len(data) < 2 || len(data) < int(data[1])+2 {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return "", err
+		}
+		data = append(data, buffer[:n]...)
+	}
+	return parsePasswordResponse(data)
+}
+
+// parsePasswordResponse extract the password of the robot response, the
+// length byte is checked against the data received
+func parsePasswordResponse(data []byte) (string, error) {
+	if len(data) < 2 {
+		return "", errors.New("robot response is too short")
+	}
+	end := int(data[1]) + 2
+	if end <= len(password_request) || end > len(data) {
+		return "", errors.New("robot refused to give its password, is it on the dock with the home button held?")
+	}
+
+	return strings.TrimRight(string(data[len(password_request):end]), "\x00"), nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParsePasswordResponse(t *testing.T) {
+	header := []byte{0xf0, 0x00, 0xef, 0xcc, 0x3b, 0x29, 0x00}
+	response := func(length byte, password string) []byte {
+		data := append([]byte{}, header...)
+		data[1] = length
+		return append(data, password...)
+	}
+
+	tests := []struct {
+		data     []byte
+		password string
+		ok       bool
+	}{
+		{response(5+9, ":1:secret"), ":1:secret", true},
+		{response(5+10, ":1:secret\x00"), ":1:secret", true},
+		// the robot echo the request when it refuses
+		{response(5, ""), "", false},
+		{[]byte{0xf0}, "", false},
+		// length bytes out of the data received
+		{response(2, "password"), "", false},
+		{response(0, "password"), "", false},
+		{response(200, "password"), "", false},
+	}
+	for i := range tests {
+		password, err := parsePasswordResponse(tests[i].data)
+		if (err == nil) != tests[i].ok || password != tests[i].password {
+			t.Errorf("parsePasswordResponse(%x) = %q, %v", tests[i].data, password, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Raw forwarding of the robot messages, the topic variables are
+//
+//	{base}   MQTT_BASE_TOPIC
+//	{blid}   robot blid
+//	{name}   slugified robot name, blid until the robot reports it
+//	{topic}  topic of the robot message, raw topic only
+var RAW_ENABLED = true
+var RAW_TOPIC = "{base}/raw/{topic}"
+
+// RAW_SHADOW publish the merged shadow retained instead of each message
+var RAW_SHADOW = false
+
+// RAW_FLATTEN publish each reported key on its own retained topic below
+// RAW_FLATTEN_TOPIC, e.g. roomba2mqtt/<name>/state/batPct. RAW_FLATTEN_KEYS
+// limit it to some top level keys.
+var RAW_FLATTEN = false
+var RAW_FLATTEN_TOPIC = "{base}/{name}/state"
+var RAW_FLATTEN_KEYS []string
+
+func (self *Client) rawTopic(template string, topic string) string {
+	name := Slugify(self.HomeAssistant.RobotName)
+	if name == "" {
+		name = self.Id()
+	}
+	return path.Clean(strings.NewReplacer(
+		"{base}", master_mqtt_topic,
+		"{blid}", self.Id(),
+		"{name}", name,
+		"{topic}", topic,
+	).Replace(template))
+}
+
+// FlattenShadow add a topic per scalar of the reported state, nested objects
+// are walked and arrays published as JSON
+func FlattenShadow(base string, reported map[string]interface{}, topics map[string][]byte) {
+	for key, value := range reported {
+		topic := base + "/" + key
+		switch v := value.(type) {
+		case map[string]interface{}:
+			FlattenShadow(topic, v, topics)
+		case string:
+			topics[topic] = []byte(v)
+		default:
+			data, err := json.Marshal(v)
+			if err == nil {
+				topics[topic] = data
+			}
+		}
+	}
+}
+
+func (self *Client) flattenedTopics(reported map[string]interface{}) map[string][]byte {
+	return_value := map[string][]byte{}
+	if len(RAW_FLATTEN_KEYS) > 0 {
+		filtered := map[string]interface{}{}
+		for key, value := range reported {
+			if containsString(RAW_FLATTEN_KEYS, key) {
+				filtered[key] = value
+			}
+		}
+		reported = filtered
+	}
+	FlattenShadow(self.rawTopic(RAW_FLATTEN_TOPIC, ""), reported, return_value)
+	return return_value
+}
+
+// IsRawTopic tell if a retained topic is a live raw topic. Every key below
+// the flattened topic is live, the robot may not have reported it again yet.
+func (self *Client) IsRawTopic(topic string) bool {
+	if !RAW_ENABLED || self.RoombaId == "" {
+		return false
+	}
+	if RAW_SHADOW && topic == self.rawTopic(RAW_TOPIC, path.Join("$aws/things", self.RoombaId, "shadow/update")) {
+		return true
+	}
+	return RAW_FLATTEN && strings.HasPrefix(topic, self.rawTopic(RAW_FLATTEN_TOPIC, "")+"/")
+}
+
+// PublishRaw forward a robot message on the master broker, reported is the
+// part of the shadow the message updated
+func (self *Client) PublishRaw(topic string, payload []byte, reported map[string]interface{}) {
+	if !RAW_ENABLED {
+		return
+	}
+
+	dst_topic := self.rawTopic(RAW_TOPIC, topic)
+	var err error
+	if RAW_SHADOW {
+		if reported == nil {
+			return
+		}
+		data, _ := json.Marshal(map[string]interface{}{
+			"state": map[string]interface{}{"reported": self.Shadow},
+		})
+		err = self.HomeAssistant.MasterMqttClient.Publish(dst_topic, data, global_qos_value, true)
+	} else {
+		err = self.HomeAssistant.MasterMqttClient.Publish(dst_topic, payload, 2, false)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("dst_topic", dst_topic).Msg("mapping message")
+		return
+	}
+	log.Info().Str("broker", self.Broker).Str("dst_topic", dst_topic).Msg("mapping message")
+
+	if RAW_FLATTEN && reported != nil {
+		// the whole shadow is published again when the topics moved
+		flatten_base := self.rawTopic(RAW_FLATTEN_TOPIC, "")
+		if flatten_base != self.flatten_base {
+			reported = self.Shadow
+			self.flatten_base = flatten_base
+		}
+		topics := self.flattenedTopics(reported)
+		keys := []string{}
+		for key := range topics {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for i := range keys {
+			err = self.HomeAssistant.MasterMqttClient.Publish(keys[i], topics[keys[i]], global_qos_value, true)
+			if err != nil {
+				log.Warn().Err(err).Str("dst_topic", keys[i]).Msg("mapping message")
+				self.flatten_base = ""
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Raw commands received on <RAW_COMMAND_TOPIC>/cmd and
+// <RAW_COMMAND_TOPIC>/delta, roomba2mqtt/<blid>/cmd by default, are forwarded
+// to the robot. The topic has the variables of RAW_TOPIC but {topic}. They
+// bypass the command sequences and must be enabled. The allowlists limit the
+// commands and the delta state keys accepted, everything is accepted when
+// empty.
+var RAW_COMMAND_ENABLED = false
+var RAW_COMMAND_TOPIC = "{base}/{blid}"
+var RAW_COMMAND_ALLOWLIST []string
+var RAW_DELTA_ALLOWLIST []string
+
+// ValidateRawCommand check a raw robot command and fill the time and the
+// initiator when missing
+func ValidateRawCommand(payload []byte) ([]byte, error) {
+	cmd := map[string]interface{}{}
+	err := json.Unmarshal(payload, &cmd)
+	if err != nil {
+		return nil, err
+	}
+	command, ok := cmd["command"].(string)
+	if !ok || command == "" {
+		return nil, errors.New("command is missing")
+	}
+	if len(RAW_COMMAND_ALLOWLIST) > 0 && !containsString(RAW_COMMAND_ALLOWLIST, command) {
+		return nil, fmt.Errorf("command %s is not allowed", command)
+	}
+	if _, ok := cmd["time"]; !ok {
+		cmd["time"] = time.Now().Unix()
+	}
+	if _, ok := cmd["initiator"]; !ok {
+		cmd["initiator"] = COMMAND_INITIATOR
+	}
+	return json.Marshal(cmd)
+}
+
+// ValidateRawDelta check a raw robot setting, {"state": {...}} or the bare
+// state
+func ValidateRawDelta(payload []byte) ([]byte, error) {
+	delta := map[string]interface{}{}
+	err := json.Unmarshal(payload, &delta)
+	if err != nil {
+		return nil, err
+	}
+	state, ok := delta["state"].(map[string]interface{})
+	if !ok || len(delta) != 1 {
+		state = delta
+	}
+	if len(state) == 0 {
+		return nil, errors.New("state is empty")
+	}
+	for key := range state {
+		if len(RAW_DELTA_ALLOWLIST) > 0 && !containsString(RAW_DELTA_ALLOWLIST, key) {
+			return nil, fmt.Errorf("setting %s is not allowed", key)
+		}
+	}
+	return json.Marshal(map[string]interface{}{"state": state})
+}
+
+// ConfigureRawCommands register the raw command topics of the robot once its
+// id is known. The topics of the previous id or name are forgotten,
+// SubscribeCommands unsubscribe them.
+func (self *HomeAssistant) ConfigureRawCommands() {
+	if !RAW_COMMAND_ENABLED || self.RobotId == "" {
+		return
+	}
+	if self.CommandHandlers == nil {
+		self.CommandHandlers = map[string]SubscribeHandleFunction{}
+	}
+	if self.raw_command_base != "" {
+		delete(self.CommandHandlers, path.Join(self.raw_command_base, "cmd"))
+		delete(self.CommandHandlers, path.Join(self.raw_command_base, "delta"))
+	}
+	name := Slugify(self.RobotName)
+	if name == "" {
+		name = self.RobotId
+	}
+	self.raw_command_base = path.Clean(strings.NewReplacer(
+		"{base}", self.CommandBaseTopic,
+		"{blid}", self.RobotId,
+		"{name}", name,
+	).Replace(RAW_COMMAND_TOPIC))
+	self.CommandHandlers[path.Join(self.raw_command_base, "cmd")] = self.rawHandler("cmd", ValidateRawCommand)
+	self.CommandHandlers[path.Join(self.raw_command_base, "delta")] = self.rawHandler("delta", ValidateRawDelta)
+}
+
+func (self *HomeAssistant) rawHandler(robot_topic string, validate func([]byte) ([]byte, error)) SubscribeHandleFunction {
+	return func(topic string, payload []byte) {
+		data, err := validate(payload)
+		if err != nil {
+			log.Warn().Err(err).Str("topic", topic).Msg("Raw command refused")
+			return
+		}
+		if self.MqttClient == nil {
+			log.Warn().Str("topic", topic).Msg("Raw command refused: robot is not connected")
+			return
+		}
+		log.Info().Str("topic", topic).Str("robot_topic", robot_topic).RawJSON("payload", data).Msg("Raw command")
+		err = self.MqttClient.Publish(robot_topic, data, 0, false)
+		if err != nil {
+			log.Warn().Err(err).Str("topic", topic).Msg("Raw command")
+		}
+	}
+}
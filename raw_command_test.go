@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// TestRawCommandTopics check that the raw command topics follow the robot id
+// and RAW_COMMAND_TOPIC, and that they are only subscribed when enabled
+func TestRawCommandTopics(t *testing.T) {
+	DATA_FOLDER = t.TempDir()
+	DEBUG_FOLDER = ""
+	retained_registry = nil
+	t.Cleanup(func() {
+		RAW_COMMAND_ENABLED = false
+		RAW_COMMAND_TOPIC = "{base}/{blid}"
+	})
+
+	topic := "$aws/things/" + test_blid + "/shadow/update"
+	messages := []CapturedMessage{
+		{Topic: topic, Payload: []byte(`{"state":{"reported":{"name":"Test Roomba","sku":"i755020"}}}`)},
+	}
+	// robotCommands deliver a message on topic and return what the robot
+	// received
+	robotCommands := func(client *Client, master *FakeMqttClient, topic string, payload string) []FakeMqttMessage {
+		var robot *FakeMqttClient
+		client.Loop.Call(func() {
+			robot = client.HomeAssistant.MqttClient.(*MetricsMqttClient).MqttClient.(*CaptureMqttClient).MqttClient.(*FakeMqttClient)
+		})
+		master.Deliver(topic, []byte(payload))
+		client.Loop.Call(func() {})
+		return robot.Messages()
+	}
+
+	master := NewFakeMqttClient()
+	master.Connect()
+	client, err := ReplayCapture(master, messages, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received := robotCommands(client, master, "roomba2mqtt/"+test_blid+"/cmd", `{"command":"find"}`); len(received) != 0 {
+		t.Errorf("raw command forwarded while disabled: %v", received)
+	}
+
+	RAW_COMMAND_ENABLED = true
+	master = NewFakeMqttClient()
+	master.Connect()
+	client, err = ReplayCapture(master, messages, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := robotCommands(client, master, "roomba2mqtt/"+test_blid+"/cmd", `{"command":"find"}`)
+	if len(received) != 1 || received[0].Topic != "cmd" {
+		t.Fatalf("robot received %v, want the find command", received)
+	}
+	cmd := map[string]interface{}{}
+	json.Unmarshal(received[0].Payload, &cmd)
+	if cmd["command"] != "find" || cmd["initiator"] != COMMAND_INITIATOR {
+		t.Errorf("robot command %v", cmd)
+	}
+	received = robotCommands(client, master, "roomba2mqtt/"+test_blid+"/delta", `{"state":{"binPause":true}}`)
+	if len(received) != 2 || received[1].Topic != "delta" || string(received[1].Payload) != `{"state":{"binPause":true}}` {
+		t.Errorf("robot received %v, want the delta", received)
+	}
+
+	// the topic can follow the robot name
+	RAW_COMMAND_TOPIC = "{base}/{name}/raw"
+	master = NewFakeMqttClient()
+	master.Connect()
+	client, err = ReplayCapture(master, messages, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received := robotCommands(client, master, "roomba2mqtt/"+test_blid+"/raw/cmd", `{"command":"find"}`); len(received) != 0 {
+		t.Errorf("raw command forwarded on the topic of the blid: %v", received)
+	}
+	if received := robotCommands(client, master, "roomba2mqtt/test_roomba/raw/cmd", `{"command":"find"}`); len(received) != 1 {
+		t.Errorf("robot received %v, want the find command", received)
+	}
+}
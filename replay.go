@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type CapturedMessage struct {
+	Time    time.Time
+	Topic   string
+	Payload []byte
+}
+
+// ReadCapture parse a debug capture: the JSON-lines capture, only the
+// messages received from the robot are kept, or the previous text format
+// with one "topic      payload" line per message
+func ReadCapture(file_name string) ([]CapturedMessage, error) {
+	f, err := os.Open(file_name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return_value := []CapturedMessage{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line_number := 0
+	for scanner.Scan() {
+		line_number++
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "{") {
+			record, payload, err := ParseCaptureRecord(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", file_name, line_number, err)
+			}
+			if record.Direction == capture_robot_in {
+				return_value = append(return_value, CapturedMessage{
+					Time:    record.Time,
+					Topic:   record.Topic,
+					Payload: payload,
+				})
+			}
+			continue
+		}
+		index := strings.IndexByte(line, ' ')
+		if index <= 0 {
+			return nil, fmt.Errorf("%s:%d: no payload", file_name, line_number)
+		}
+		return_value = append(return_value, CapturedMessage{
+			Topic:   line[:index],
+			Payload: []byte(strings.TrimLeft(line[index:], " ")),
+		})
+	}
+	return return_value, scanner.Err()
+}
+
+// PrintMqttClient is the dry-run target of replay, the published messages
+// are printed
+type PrintMqttClient struct {
+	*FakeMqttClient
+	Output io.Writer
+}
+
+func (self *PrintMqttClient) Publish(topic string, payload []byte, qos uint8, retain bool) error {
+	fmt.Fprintf(self.Output, "%s retain=%t %s\n", topic, retain, payload)
+	return self.FakeMqttClient.Publish(topic, payload, qos, retain)
+}
+
+// Replay feed a debug capture through the bridge, publishing on the master
+// broker or printing with -dry-run. Return the process exit code.
+func Replay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	delay := flags.Duration("delay", 0, "wait between two messages")
+	realtime := flags.Bool("realtime", false, "wait between two messages as long as recorded in the capture")
+	dry_run := flags.Bool("dry-run", false, "print the messages instead of publishing them")
+	data_dir := flags.String("data", "", "data folder of the replayed robot, a temporary folder when empty")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: roomba2mqtt replay [-delay 1s | -realtime] [-dry-run] [-data folder] <file>")
+		return 2
+	}
+
+	messages, err := ReadCapture(flags.Arg(0))
+	if err != nil {
+		log.Error().Err(err).Msg("replay")
+		return 1
+	}
+
+	// the replayed messages are not captured again and the data of the real
+	// robot is left alone
+	DEBUG_FOLDER = ""
+	DATA_FOLDER = *data_dir
+	if DATA_FOLDER == "" {
+		DATA_FOLDER, err = os.MkdirTemp("", "roomba2mqtt-replay")
+		if err != nil {
+			log.Error().Err(err).Msg("replay")
+			return 1
+		}
+		defer os.RemoveAll(DATA_FOLDER)
+	}
+
+	var master MqttClient
+	if *dry_run {
+		master = &PrintMqttClient{FakeMqttClient: NewFakeMqttClient(), Output: os.Stdout}
+	} else {
+		config, err := NewMasterMqttConfig()
+		if err == nil {
+			master, err = NewMqttClient(config)
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("master MQTT configuration")
+			return 1
+		}
+	}
+	err = master.Connect()
+	if err != nil {
+		log.Error().Err(err).Msg("master MQTT connection")
+		return 1
+	}
+
+	client, err := ReplayCapture(master, messages, *delay, *realtime)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	master.Disconnect(ctx)
+	if err != nil {
+		log.Error().Err(err).Str("file_name", flags.Arg(0)).Msg("replay")
+		return 1
+	}
+	log.Info().Int("count", len(messages)).Str("blid", client.RoombaId).Msg("Replayed")
+	return 0
+}
+
+// ReplayCapture deliver the messages of a capture to a new client of the
+// robot found in the capture, publishing on master. The client is returned
+// once every message is handled, the captures can be checked in tests.
+func ReplayCapture(master MqttClient, messages []CapturedMessage, delay time.Duration, realtime bool) (*Client, error) {
+	blid := ""
+	for i := range messages {
+		if strings.HasPrefix(messages[i].Topic, "$aws/things/") {
+			blid = strings.Split(messages[i].Topic, "/")[2]
+			break
+		}
+	}
+	if blid == "" {
+		return nil, errors.New("no robot message in capture")
+	}
+
+	master_mqtt_client = master
+	client := NewClient(MqttConfig{Broker: "replay", Username: blid}, master)
+	vacuum_client_list = []*Client{client}
+	robot := NewFakeMqttClient()
+	robot.Connect()
+	go SubscribeToRoomba(client, client.SubscribeChannel)
+	client.ConnectionChannel <- robot
+	<-client.SubscribeChannel
+
+	for i := range messages {
+		if i > 0 && realtime && !messages[i-1].Time.IsZero() {
+			time.Sleep(messages[i].Time.Sub(messages[i-1].Time))
+		} else if i > 0 && delay > 0 {
+			time.Sleep(delay)
+		}
+		robot.Deliver(messages[i].Topic, messages[i].Payload)
+	}
+	// wait for the loop to handle every message
+	client.Loop.Call(func() {})
+	return client, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// TestReplayCapture replay the checked-in capture of a mission and check what
+// is published to Home Assistant
+func TestReplayCapture(t *testing.T) {
+	DATA_FOLDER = t.TempDir()
+	DEBUG_FOLDER = ""
+	retained_registry = nil
+
+	messages, err := ReadCapture("testdata/capture.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 4 {
+		t.Fatalf("%d messages read, want the 4 robot_in records", len(messages))
+	}
+
+	master := NewFakeMqttClient()
+	master.Connect()
+	client, err := ReplayCapture(master, messages, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.RoombaId != test_blid {
+		t.Errorf("robot id %s, want %s", client.RoombaId, test_blid)
+	}
+
+	var state_topic string
+	client.Loop.Call(func() {
+		state_topic = client.HomeAssistant.Vacuum.Config.StateTopic
+	})
+	raw_topic := "roomba2mqtt/raw/$aws/things/" + test_blid + "/shadow/update"
+	event_prefix := "roomba2mqtt/device_automation/homeassistant/" + test_blid + "_"
+	states := []VacuumState{}
+	events := []string{}
+	raw := 0
+	for _, message := range master.Messages() {
+		switch {
+		case message.Topic == state_topic:
+			state := VacuumState{}
+			err := json.Unmarshal(message.Payload, &state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state.State != "" {
+				states = append(states, state)
+			}
+		case message.Topic == raw_topic:
+			raw++
+		case len(message.Topic) > len(event_prefix) && message.Topic[:len(event_prefix)] == event_prefix:
+			events = append(events, string(message.Payload))
+		}
+	}
+
+	want_states := []VacuumState{
+		{State: docked_state, BatteryLevel: 100},
+		{State: cleaning_state, BatteryLevel: 99},
+		{State: docked_state, BatteryLevel: 97},
+		{State: docked_state, BatteryLevel: 96},
+	}
+	if !reflect.DeepEqual(states, want_states) {
+		t.Errorf("states %+v, want %+v", states, want_states)
+	}
+	want_events := []string{"mission_started", "mission_completed", "docked"}
+	if !reflect.DeepEqual(events, want_events) {
+		t.Errorf("events %v, want %v", events, want_events)
+	}
+	if raw != len(messages) {
+		t.Errorf("%d raw messages, want %d", raw, len(messages))
+	}
+
+	// the master_out record of the capture is not replayed
+	config := VacuumConfig{}
+	err = json.Unmarshal(master.Retained["homeassistant/vacuum/"+test_blid+"/vacuum/config"], &config)
+	if err != nil || config.Name != "Test Roomba" {
+		t.Errorf("vacuum config %+v, %v", config, err)
+	}
+
+	mission := map[string]interface{}{}
+	err = json.Unmarshal(master.Retained["roomba2mqtt/camera/homeassistant/"+test_blid+"_mission_map/attributes"], &mission)
+	if err != nil || mission["initiator"] != "localApp" || mission["points"] != float64(2) {
+		t.Errorf("mission map attributes %v, %v", mission, err)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RetainedRegistry remember every retained topic published by the bridge and
+// the robot that owns it, so the retained messages of entities that no longer
+// exist can be removed from the broker
+type RetainedRegistry struct {
+	FileName string
+	Topics   map[string]string
+	mutex    sync.Mutex
+}
+
+var retained_registry *RetainedRegistry
+
+func LoadRetainedRegistry(data_dir string) *RetainedRegistry {
+	return_value := &RetainedRegistry{
+		FileName: path.Join(data_dir, "retained.json"),
+		Topics:   map[string]string{},
+	}
+
+	data, err := ioutil.ReadFile(return_value.FileName)
+	if err == nil {
+		err = json.Unmarshal(data, &return_value.Topics)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Error().Err(err).Str("file_name", return_value.FileName).Msg("Loading retained topics")
+	}
+	return return_value
+}
+
+func (self *RetainedRegistry) save() {
+	os.MkdirAll(path.Dir(self.FileName), 0755)
+
+	data, err := json.Marshal(self.Topics)
+	if err == nil {
+		err = ioutil.WriteFile(self.FileName, data, 0644)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("file_name", self.FileName).Msg("Saving retained topics")
+	}
+}
+
+// Published record a retained publish, an empty payload clear the topic
+func (self *RetainedRegistry) Published(topic string, owner string, payload []byte) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	current, ok := self.Topics[topic]
+	if len(payload) == 0 {
+		if ok {
+			delete(self.Topics, topic)
+			self.save()
+		}
+		return
+	}
+	if !ok || current != owner {
+		self.Topics[topic] = owner
+		self.save()
+	}
+}
+
+// Stale return the topics matching the filter that are not live, sorted
+func (self *RetainedRegistry) Stale(filter func(topic string, owner string) bool, live []string) []string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	live_map := map[string]bool{}
+	for i := range live {
+		live_map[live[i]] = true
+	}
+
+	return_value := []string{}
+	for topic, owner := range self.Topics {
+		if !live_map[topic] && filter(topic, owner) {
+			return_value = append(return_value, topic)
+		}
+	}
+	sort.Strings(return_value)
+	return return_value
+}
+
+func (self *RetainedRegistry) All() []string {
+	return self.Stale(func(topic string, owner string) bool { return true }, nil)
+}
+
+// Clear publish an empty retained message on each topic, removing them from
+// the broker and from the registry
+func (self *RetainedRegistry) Clear(client MqttClient, topics []string) {
+	for i := range topics {
+		log.Info().Str("topic", topics[i]).Msg("Removing stale retained message")
+		err := client.Publish(topics[i], []byte{}, global_qos_value, true)
+		if err != nil {
+			log.Error().Err(err).Str("topic", topics[i]).Msg("Removing stale retained message")
+			continue
+		}
+		self.Published(topics[i], "", nil)
+	}
+}
+
+// RetainedMqttClient record in the registry the retained messages published
+// on behalf of a robot
+type RetainedMqttClient struct {
+	MqttClient
+	Client *Client
+}
+
+func (self *RetainedMqttClient) Publish(topic string, payload []byte, qos uint8, retain bool) error {
+	err := self.MqttClient.Publish(topic, payload, qos, retain)
+	if err == nil && retain && retained_registry != nil {
+		retained_registry.Published(topic, self.Client.Id(), payload)
+	}
+	return err
+}
+
+// CleanupRetained remove the retained messages of this robot that do not
+// belong to a live entity anymore
+func (self *Client) CleanupRetained() {
+	if retained_registry == nil {
+		return
+	}
+	owner := self.Id()
+	stale := retained_registry.Stale(func(topic string, topic_owner string) bool {
+		return topic_owner == owner && !self.IsRawTopic(topic)
+	}, self.HomeAssistant.RetainedTopics())
+	retained_registry.Clear(self.HomeAssistant.MasterMqttClient, stale)
+}
+
+// CleanupRemovedRobots remove the retained messages of robots that are not
+// configured anymore
+func CleanupRemovedRobots() {
+	if retained_registry == nil {
+		return
+	}
+	configured := map[string]bool{}
+	for i := range vacuum_client_list {
+		configured[vacuum_client_list[i].LockedId()] = true
+		configured[vacuum_client_list[i].MqttConfig.Username] = true
+	}
+	stale := retained_registry.Stale(func(topic string, owner string) bool {
+		return !configured[owner]
+	}, nil)
+	retained_registry.Clear(master_mqtt_client, stale)
+}
+
+// Purge remove every retained message the bridge ever published
+func Purge() int {
+	err := master_mqtt_client.Connect()
+	if err != nil {
+		log.Error().Err(err).Msg("master MQTT connection")
+		return 1
+	}
+
+	topics := retained_registry.All()
+	retained_registry.Clear(master_mqtt_client, topics)
+	log.Info().Int("count", len(topics)).Msg("Purged retained messages")
+
+	if len(retained_registry.All()) > 0 {
+		return 1
+	}
+	return 0
+}
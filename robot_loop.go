@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Size of the event and command queues of a robot
+const robot_loop_queue = 100
+
+var ErrCommandQueueFull = errors.New("command queue is full")
+
+type RobotCommand struct {
+	Command string
+	PmapId  string
+	Regions []RoombaRegion
+	result  chan error
+}
+
+// RobotLoop serialize the changes of a robot state. The MQTT callbacks and
+// the web handlers post events that run one at a time on the loop goroutine,
+// holding Lock so readers can take it for a consistent view. Commands run on
+// their own goroutine, one after the other, so a command waiting on the robot
+// does not stop the state updates.
+type RobotLoop struct {
+	Lock     sync.Locker
+	Execute  func(cmd RobotCommand) error
+	events   chan func()
+	commands chan RobotCommand
+	// only used from the loop goroutine
+	waiters []*loopWaiter
+}
+
+type loopWaiter struct {
+	cond func() bool
+	done chan bool
+}
+
+func NewRobotLoop(lock sync.Locker, execute func(cmd RobotCommand) error) *RobotLoop {
+	return &RobotLoop{
+		Lock:     lock,
+		Execute:  execute,
+		events:   make(chan func(), robot_loop_queue),
+		commands: make(chan RobotCommand, robot_loop_queue),
+	}
+}
+
+func (self *RobotLoop) Start() {
+	go self.run()
+	go self.runCommands()
+}
+
+func (self *RobotLoop) run() {
+	for fnc := range self.events {
+		self.Lock.Lock()
+		fnc()
+		self.checkWaiters()
+		self.Lock.Unlock()
+	}
+}
+
+func (self *RobotLoop) checkWaiters() {
+	waiters := self.waiters[:0]
+	for _, waiter := range self.waiters {
+		if waiter.cond() {
+			waiter.done <- true
+		} else {
+			waiters = append(waiters, waiter)
+		}
+	}
+	self.waiters = waiters
+}
+
+func (self *RobotLoop) removeWaiter(waiter *loopWaiter) {
+	for i := range self.waiters {
+		if self.waiters[i] == waiter {
+			self.waiters = append(self.waiters[:i], self.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// WaitFor wait until cond is true, it is evaluated on the loop after each
+// event. Return false on timeout, never call it from the loop.
+func (self *RobotLoop) WaitFor(cond func() bool, timeout time.Duration) bool {
+	waiter := &loopWaiter{cond: cond, done: make(chan bool, 1)}
+	self.Post(func() {
+		self.waiters = append(self.waiters, waiter)
+	})
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-waiter.done:
+		return true
+	case <-timer.C:
+		self.Post(func() {
+			self.removeWaiter(waiter)
+		})
+		// the condition may have been met while the timer fired
+		select {
+		case <-waiter.done:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+func (self *RobotLoop) runCommands() {
+	for cmd := range self.commands {
+		err := self.Execute(cmd)
+		if err != nil {
+			log.Error().Err(err).Str("command", cmd.Command).Msg("Vacuum command")
+		}
+		cmd.result <- err
+	}
+}
+
+// Post run fnc on the loop, it must not be called from the loop when the
+// queue may be full
+func (self *RobotLoop) Post(fnc func()) {
+	self.events <- fnc
+}
+
+// Call run fnc on the loop and wait for it, never call it from the loop
+func (self *RobotLoop) Call(fnc func()) {
+	done := make(chan bool)
+	self.events <- func() {
+		fnc()
+		close(done)
+	}
+	<-done
+}
+
+// Handler wrap a subscription handler so the messages are handled on the loop
+func (self *RobotLoop) Handler(fnc SubscribeHandleFunction) SubscribeHandleFunction {
+	return func(topic string, payload []byte) {
+		self.Post(func() {
+			fnc(topic, payload)
+		})
+	}
+}
+
+// Queue add a command to the queue without waiting, the returned channel
+// receive the result once the command has run
+func (self *RobotLoop) Queue(cmd RobotCommand) <-chan error {
+	cmd.result = make(chan error, 1)
+	select {
+	case self.commands <- cmd:
+	default:
+		cmd.result <- ErrCommandQueueFull
+	}
+	return cmd.result
+}
+
+// Wait for the result of a queued command or the end of the context
+func WaitCommand(ctx context.Context, result <-chan error) error {
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ExecuteCommand is the Execute function of the robot loop
+func (self *Client) ExecuteCommand(cmd RobotCommand) error {
+	return self.HomeAssistant.Vacuum.ExecuteCommand(cmd.Command, cmd.PmapId, cmd.Regions)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const test_blid = "3145C91012345678"
+const test_password = ":1:1600000000:TestRobot0000001"
+
+// startSimulatedRobot serve a simulated robot on a plain TCP listener
+func startSimulatedRobot(t *testing.T) (*SimulatedRobot, MqttConfig) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	robot := NewSimulatedRobot(test_blid, test_password, "Test Roomba")
+	robot.StuckOdds = 0
+	go robot.Broker.Serve(listener)
+
+	return robot, MqttConfig{
+		Broker:     "127.0.0.1",
+		Port:       uint(listener.Addr().(*net.TCPAddr).Port),
+		Username:   test_blid,
+		Password:   test_password,
+		Version:    4,
+		CleanStart: true,
+	}
+}
+
+// startBridge connect a bridge client to the robot and to the master client
+// and wait for the first state of the robot
+func startBridge(t *testing.T, robot_config MqttConfig, master MqttClient) *Client {
+	DATA_FOLDER = t.TempDir()
+	DEBUG_FOLDER = ""
+	retained_registry = nil
+	master_mqtt_client = master
+
+	client := NewClient(robot_config, master)
+	vacuum_client_list = []*Client{client}
+
+	robot_client, err := NewMqttClient(robot_config)
+	if err == nil {
+		err = robot_client.Connect()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		robot_client.Disconnect(ctx)
+	})
+	go SubscribeToRoomba(client, client.SubscribeChannel)
+	client.ConnectionChannel <- robot_client
+	<-client.SubscribeChannel
+
+	reported := client.Loop.WaitFor(func() bool {
+		return client.HomeAssistant.Vacuum.Phase != ""
+	}, 5*time.Second)
+	if !reported {
+		t.Fatal("the robot did not report its state")
+	}
+	return client
+}
+
+// TestRobotLoopRace drive a simulated robot with commands while the HTTP,
+// metrics and health readers run, go test -race report the unlocked accesses
+func TestRobotLoopRace(t *testing.T) {
+	robot, config := startSimulatedRobot(t)
+	master := NewFakeMqttClient()
+	master.Connect()
+	client := startBridge(t, config, master)
+
+	done := make(chan bool)
+	wait_group := sync.WaitGroup{}
+	wait_group.Add(2)
+	go func() {
+		defer wait_group.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			robot.mutex.Lock()
+			robot.battery = 100
+			robot.mutex.Unlock()
+			robot.Tick()
+			// a robot report about once a second, the loop save the state on
+			// each report
+			time.Sleep(200 * time.Millisecond)
+		}
+	}()
+	go func() {
+		defer wait_group.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			FindClient(test_blid)
+			client.ApiState()
+			client.ApiMaps()
+			client.View()
+			client.gauges()
+			client.IsReady()
+			client.LockedName()
+		}
+	}()
+
+	for _, command := range []string{"start", "pause", "start", "stop", "dock"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := WaitCommand(ctx, client.Loop.Queue(RobotCommand{Command: command}))
+		cancel()
+		if err != nil {
+			t.Errorf("%s: %s", command, err)
+		}
+	}
+	close(done)
+	wait_group.Wait()
+
+	var phase string
+	client.Loop.Call(func() {
+		phase = client.HomeAssistant.Vacuum.Phase
+	})
+	if !containsString(dock_phases, phase) {
+		t.Errorf("phase %s after dock, want a dock phase", phase)
+	}
+}
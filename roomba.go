@@ -2,6 +2,20 @@ package main
 
 type CleanMissionStatus struct {
 	Phase string `json:"phase"`
+	Cycle string `json:"cycle"`
+	NMssn int    `json:"nMssn"`
+	// Initiator of the mission: schedule, localApp, rmtApp, manual, ...
+	Initiator string `json:"initiator"`
+}
+
+type PosePoint struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type Pose struct {
+	Theta int       `json:"theta"`
+	Point PosePoint `json:"point"`
 }
 
 type RoombaRegionParams struct {
@@ -18,7 +32,7 @@ type RoombaRegion struct {
 type Command struct {
 	Command   string         `json:"command,omitempty"`
 	Initiator string         `json:"initiator,omitempty"`
-	Time      int            `json:"time,omitempty"`
+	Time      int64          `json:"time,omitempty"`
 	Regions   []RoombaRegion `json:"regions,omitempty"`
 	PmapId    string         `json:"pmap_id,omitempty"`
 }
@@ -43,6 +57,7 @@ type Reported struct {
 	CleanMissionStatus *CleanMissionStatus `json:"cleanMissionStatus,omitempty"`
 	LastCommand        *Command            `json:"lastCommand,omitempty"`
 	Maps               *[]MapMap           `json:"pmaps,omitempty"`
+	Pose               *Pose               `json:"pose,omitempty"`
 }
 
 type State struct {
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	mrand "math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Simulated robot settings, overridden by the SIMULATE_* env variables
+var SIMULATE_HOST = "127.0.0.1"
+var SIMULATE_BLID = "3145C91012345678"
+var SIMULATE_PASSWORD = ":1:1600000000:SimulatedRobot01"
+var SIMULATE_NAME = "Simulated Roomba"
+var SIMULATE_SKU = "i755020"
+var SIMULATE_BROKER_ADDRESS = "127.0.0.1:1883"
+var SIMULATE_TICK = time.Second
+
+// SimulatedRobot imitate the local MQTT interface of a Roomba: it reports
+// its shadow on $aws/things/<blid>/shadow/update, accepts the commands on
+// cmd and settings on delta, goes through the mission phases, drains its
+// battery, fills its bin and sometimes gets stuck.
+type SimulatedRobot struct {
+	Blid     string
+	Password string
+	Name     string
+	Broker   *MqttBroker
+	// StuckOdds is the one in StuckOdds chance per tick to get stuck while
+	// cleaning, never when 0
+	StuckOdds int
+	phase     string
+	cycle     string
+	initiator string
+	battery   float64
+	bin_full  bool
+	mission   int
+	minutes   int
+	sqft      int
+	ticks     int
+	pose      Pose
+	command   Command
+	random    *mrand.Rand
+	mutex     sync.Mutex
+}
+
+var simulated_maps = []MapMap{{"SimMap0000000001": "Home"}}
+var simulated_regions = []RoombaRegion{
+	{RegionId: "1", Type: "rid"},
+	{RegionId: "2", Type: "rid"},
+	{RegionId: "3", Type: "rid"},
+	{RegionId: "1", Type: "zid"},
+}
+
+func NewSimulatedRobot(blid string, password string, name string) *SimulatedRobot {
+	return_value := &SimulatedRobot{
+		Blid:      blid,
+		Password:  password,
+		Name:      name,
+		phase:     "charge",
+		cycle:     "none",
+		initiator: "none",
+		battery:   100,
+		random:    mrand.New(mrand.NewSource(time.Now().UnixNano())),
+		StuckOdds: 300,
+		command: Command{
+			Command:   "start",
+			Initiator: "localApp",
+			PmapId:    "SimMap0000000001",
+			Regions:   simulated_regions,
+		},
+	}
+	return_value.Broker = NewMqttBroker("robot")
+	return_value.Broker.Authenticate = func(client_id string, username string, password []byte) bool {
+		return username == return_value.Blid && string(password) == return_value.Password
+	}
+	return_value.Broker.OnPublish = return_value.handleMessage
+	// the robot sends its whole state to a new client
+	return_value.Broker.OnSubscribe = func(filters []string) {
+		return_value.ReportAll()
+	}
+	return return_value
+}
+
+func (self *SimulatedRobot) topic() string {
+	return fmt.Sprintf("$aws/things/%s/shadow/update", self.Blid)
+}
+
+// report publish a part of the shadow, like the robot does
+func (self *SimulatedRobot) report(reported map[string]interface{}) {
+	data, err := json.Marshal(map[string]interface{}{
+		"state": map[string]interface{}{"reported": reported},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Simulated robot report")
+		return
+	}
+	self.Broker.Publish(self.topic(), data, false)
+}
+
+func (self *SimulatedRobot) missionStatus() map[string]interface{} {
+	return map[string]interface{}{
+		"cleanMissionStatus": map[string]interface{}{
+			"phase":     self.phase,
+			"cycle":     self.cycle,
+			"nMssn":     self.mission,
+			"mssnM":     self.minutes,
+			"sqft":      self.sqft,
+			"initiator": self.initiator,
+		},
+		"batPct": int(self.battery),
+		"bin":    Bin{Present: true, Full: self.bin_full},
+	}
+}
+
+// ReportAll publish the whole state
+func (self *SimulatedRobot) ReportAll() {
+	self.mutex.Lock()
+	reported := self.missionStatus()
+	reported["name"] = self.Name
+	reported["sku"] = SIMULATE_SKU
+	reported["softwareVer"] = "simulator"
+	reported["pmaps"] = simulated_maps
+	reported["lastCommand"] = self.command
+	self.mutex.Unlock()
+
+	self.report(reported)
+}
+
+func (self *SimulatedRobot) setPhase(phase string, cycle string) {
+	log.Info().Str("phase", phase).Str("cycle", cycle).Msg("Simulated robot")
+	self.phase = phase
+	self.cycle = cycle
+	self.ticks = 0
+}
+
+func (self *SimulatedRobot) handleMessage(topic string, payload []byte) {
+	switch topic {
+	case "cmd":
+		cmd := Command{}
+		err := json.Unmarshal(payload, &cmd)
+		if err != nil {
+			log.Warn().Err(err).Msg("Simulated robot command")
+			return
+		}
+		self.execute(cmd)
+	case "delta":
+		delta := map[string]map[string]interface{}{}
+		err := json.Unmarshal(payload, &delta)
+		if err != nil {
+			log.Warn().Err(err).Msg("Simulated robot delta")
+			return
+		}
+		self.mutex.Lock()
+		if name, ok := delta["state"]["name"].(string); ok {
+			self.Name = name
+		}
+		self.mutex.Unlock()
+		self.report(delta["state"])
+	}
+}
+
+func (self *SimulatedRobot) execute(cmd Command) {
+	self.mutex.Lock()
+	log.Info().Str("command", cmd.Command).Msg("Simulated robot command")
+	reported := map[string]interface{}{}
+	switch cmd.Command {
+	case "start":
+		self.mission++
+		self.minutes, self.sqft = 0, 0
+		self.pose = Pose{}
+		self.initiator = cmd.Initiator
+		self.setPhase("run", "clean")
+		if len(cmd.Regions) > 0 {
+			self.command = cmd
+			reported["lastCommand"] = cmd
+		}
+	case "train":
+		self.mission++
+		self.minutes, self.sqft = 0, 0
+		self.pose = Pose{}
+		self.initiator = cmd.Initiator
+		self.setPhase("run", "train")
+	case "find":
+		log.Info().Msg("Simulated robot beeps")
+	case "resume":
+		if self.phase == "pause" {
+			self.setPhase("run", self.cycle)
+		}
+	case "pause":
+		if self.phase == "run" {
+			self.setPhase("pause", self.cycle)
+		}
+	case "stop":
+		if self.phase != "charge" {
+			self.setPhase("stop", "none")
+		}
+	case "dock":
+		if self.phase != "charge" {
+			self.setPhase("hmUsrDock", "dock")
+		}
+	case "evac":
+		if self.phase == "charge" {
+			self.setPhase("evac", "evac")
+		}
+	}
+	for key, value := range self.missionStatus() {
+		reported[key] = value
+	}
+	self.mutex.Unlock()
+
+	self.report(reported)
+}
+
+// Tick advance the simulation by one step
+func (self *SimulatedRobot) Tick() {
+	self.mutex.Lock()
+	self.ticks++
+	reported := map[string]interface{}{}
+	switch self.phase {
+	case "run":
+		self.minutes++
+		self.sqft += 2
+		self.battery -= 0.5
+		self.pose.Theta = (self.pose.Theta + self.random.Intn(90) - 45) % 180
+		self.pose.Point.X += self.random.Intn(41) - 20
+		self.pose.Point.Y += self.random.Intn(41) - 20
+		reported["pose"] = self.pose
+		if self.minutes%120 == 0 {
+			self.bin_full = true
+		}
+		if self.battery < 15 {
+			self.setPhase("hmMidMsn", "clean")
+		} else if self.StuckOdds > 0 && self.random.Intn(self.StuckOdds) == 0 {
+			self.setPhase("stuck", self.cycle)
+		}
+	case "hmUsrDock", "hmMidMsn":
+		self.battery -= 0.2
+		if self.ticks >= 5 {
+			self.setPhase("charge", "none")
+		}
+	case "evac":
+		if self.ticks >= 3 {
+			self.bin_full = false
+			self.setPhase("charge", "none")
+		}
+	case "charge":
+		if self.battery < 100 {
+			self.battery += 1
+		}
+	}
+	if self.battery < 0 {
+		self.battery = 0
+	}
+	if self.battery > 100 {
+		self.battery = 100
+	}
+	for key, value := range self.missionStatus() {
+		reported[key] = value
+	}
+	self.mutex.Unlock()
+
+	self.report(reported)
+}
+
+func (self *SimulatedRobot) Run() {
+	ticker := time.NewTicker(SIMULATE_TICK)
+	for range ticker.C {
+		self.Tick()
+	}
+}
+
+// selfSignedCertificate create the certificate of the simulated robot, the
+// bridge does not verify it, like with the real robots
+func selfSignedCertificate(host string) (tls.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Simulate start a simulated robot and, when no master broker is configured,
+// an embedded broker, then point the bridge configuration at them so the
+// bridge runs end-to-end without network
+func Simulate() error {
+	for name, value := range map[string]*string{
+		"SIMULATE_HOST":           &SIMULATE_HOST,
+		"SIMULATE_BLID":           &SIMULATE_BLID,
+		"SIMULATE_PASSWORD":       &SIMULATE_PASSWORD,
+		"SIMULATE_NAME":           &SIMULATE_NAME,
+		"SIMULATE_SKU":            &SIMULATE_SKU,
+		"SIMULATE_BROKER_ADDRESS": &SIMULATE_BROKER_ADDRESS,
+	} {
+		if p, found := os.LookupEnv(name); found {
+			*value = p
+		}
+	}
+	tick, err := time.ParseDuration(os.Getenv("SIMULATE_TICK"))
+	if err == nil {
+		SIMULATE_TICK = tick
+	}
+
+	cert, err := selfSignedCertificate(SIMULATE_HOST)
+	if err != nil {
+		return err
+	}
+	robot_address := net.JoinHostPort(SIMULATE_HOST, "8883")
+	listener, err := tls.Listen("tcp", robot_address, &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return err
+	}
+	robot := NewSimulatedRobot(SIMULATE_BLID, SIMULATE_PASSWORD, SIMULATE_NAME)
+	go robot.Broker.Serve(listener)
+	go robot.Run()
+	log.Info().Str("address", robot_address).Str("blid", SIMULATE_BLID).Msg("Simulated robot started")
+
+	if _, found := os.LookupEnv("0_ROOMBA_ADDRESS"); !found {
+		os.Setenv("0_ROOMBA_ADDRESS", SIMULATE_HOST)
+		os.Setenv("0_ROOMBA_USER", SIMULATE_BLID)
+		os.Setenv("0_ROOMBA_PASSWORD", SIMULATE_PASSWORD)
+	}
+
+	if os.Getenv("MQTT_ADDRESS") == "" && os.Getenv("MQTT_URL") == "" {
+		broker_listener, err := net.Listen("tcp", SIMULATE_BROKER_ADDRESS)
+		if err != nil {
+			return err
+		}
+		go NewMqttBroker("master").Serve(broker_listener)
+		log.Info().Str("address", SIMULATE_BROKER_ADDRESS).Msg("Embedded master broker started")
+		os.Setenv("MQTT_URL", "mqtt://"+SIMULATE_BROKER_ADDRESS)
+		os.Setenv("MQTT_VERSION", "3.1.1")
+	}
+	return nil
+}
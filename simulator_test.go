@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSimulatedBridge run the bridge between a simulated robot and the
+// embedded broker and check what Home Assistant receives
+func TestSimulatedBridge(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	published := map[string][]byte{}
+	mutex := sync.Mutex{}
+	broker := NewMqttBroker("master")
+	broker.OnPublish = func(topic string, payload []byte) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		published[topic] = payload
+	}
+	go broker.Serve(listener)
+
+	master, err := NewMqttClient(MqttConfig{
+		Broker:     "127.0.0.1",
+		Port:       uint(listener.Addr().(*net.TCPAddr).Port),
+		ClientId:   "roomba2mqtt-test",
+		Version:    4,
+		CleanStart: true,
+	})
+	if err == nil {
+		err = master.Connect()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		master.Disconnect(ctx)
+	})
+
+	_, robot_config := startSimulatedRobot(t)
+	client := startBridge(t, robot_config, master)
+
+	vacuum_topic := "homeassistant/vacuum/" + test_blid + "/vacuum/config"
+	var state_topic, result_topic, attributes_topic string
+	client.Loop.Call(func() {
+		state_topic = client.HomeAssistant.Vacuum.Config.StateTopic
+		result_topic = client.HomeAssistant.Vacuum.ResultTopic
+		attributes_topic = client.HomeAssistant.Vacuum.Config.JsonAttributesTopic
+	})
+	// waitPublished decode the last payload of a topic into value until
+	// accept is true
+	waitPublished := func(topic string, value interface{}, accept func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			mutex.Lock()
+			payload, ok := published[topic]
+			mutex.Unlock()
+			if ok && json.Unmarshal(payload, value) == nil && accept() {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("%s not published", topic)
+	}
+
+	config := VacuumConfig{}
+	waitPublished(vacuum_topic, &config, func() bool { return true })
+	if config.StateTopic != state_topic || config.UniqueId != "roomba_"+test_blid {
+		t.Errorf("vacuum config %+v", config)
+	}
+
+	state := VacuumState{}
+	waitPublished(state_topic, &state, func() bool { return state.State != "" })
+	if state.State != docked_state || state.BatteryLevel != 100 {
+		t.Errorf("vacuum state %+v, want docked with a full battery", state)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = WaitCommand(ctx, client.Loop.Queue(RobotCommand{Command: "start"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitPublished(state_topic, &state, func() bool { return state.State == cleaning_state })
+	if state.State != cleaning_state {
+		t.Errorf("vacuum state %s after start, want %s", state.State, cleaning_state)
+	}
+
+	// the robot reports COMMAND_INITIATOR, the mission is the bridge's
+	attributes := map[string]interface{}{}
+	waitPublished(attributes_topic, &attributes, func() bool { return attributes["initiator"] == bridge_initiator })
+	if attributes["initiator"] != bridge_initiator {
+		t.Errorf("vacuum initiator %v, want %s", attributes["initiator"], bridge_initiator)
+	}
+
+	result := CommandResult{}
+	waitPublished(result_topic, &result, func() bool { return true })
+	if !result.Success || result.Command != "start" {
+		t.Errorf("command result %+v", result)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// TopicMatch tell if a topic match a subscription filter, + match one level
+// and a trailing # match the parent and every level below. Topics starting
+// with $ are not matched by a leading wildcard, the robot $aws topics need
+// their own filter.
+func TopicMatch(filter string, topic string) bool {
+	// shared subscriptions are delivered with the plain topic
+	if strings.HasPrefix(filter, "$share/") {
+		parts := strings.SplitN(filter, "/", 3)
+		if len(parts) < 3 {
+			return false
+		}
+		filter = parts[2]
+	}
+
+	filter_levels := strings.Split(filter, "/")
+	topic_levels := strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && (filter_levels[0] == "+" || filter_levels[0] == "#") {
+		return false
+	}
+	for i := range filter_levels {
+		if filter_levels[i] == "#" {
+			return i == len(filter_levels)-1
+		}
+		if i >= len(topic_levels) {
+			return false
+		}
+		if filter_levels[i] != "+" && filter_levels[i] != topic_levels[i] {
+			return false
+		}
+	}
+	return len(filter_levels) == len(topic_levels)
+}
+
+type topicRoute struct {
+	filter   string
+	handlers []SubscribeHandleFunction
+}
+
+// TopicRouter dispatch the received messages to the handlers of every
+// matching filter, it is shared by both client implementations
+type TopicRouter struct {
+	routes []*topicRoute
+	mutex  sync.RWMutex
+}
+
+// Add register a handler, return true when the filter is new and has to be
+// subscribed on the broker
+func (self *TopicRouter) Add(filter string, fnc SubscribeHandleFunction) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i := range self.routes {
+		if self.routes[i].filter == filter {
+			self.routes[i].handlers = append(self.routes[i].handlers, fnc)
+			return false
+		}
+	}
+	self.routes = append(self.routes, &topicRoute{
+		filter:   filter,
+		handlers: []SubscribeHandleFunction{fnc},
+	})
+	return true
+}
+
+// Remove drop every handler of the filter, return true when the filter was
+// registered and has to be unsubscribed on the broker
+func (self *TopicRouter) Remove(filter string) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i := range self.routes {
+		if self.routes[i].filter == filter {
+			self.routes = append(self.routes[:i], self.routes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (self *TopicRouter) Filters() []string {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	return_value := []string{}
+	for i := range self.routes {
+		return_value = append(return_value, self.routes[i].filter)
+	}
+	return return_value
+}
+
+// Route call the handlers of every filter matching the topic, the handlers
+// run outside of the lock so they can subscribe or unsubscribe
+func (self *TopicRouter) Route(topic string, payload []byte) bool {
+	self.mutex.RLock()
+	handlers := []SubscribeHandleFunction{}
+	for i := range self.routes {
+		if TopicMatch(self.routes[i].filter, topic) {
+			handlers = append(handlers, self.routes[i].handlers...)
+		}
+	}
+	self.mutex.RUnlock()
+
+	for i := range handlers {
+		handlers[i](topic, payload)
+	}
+	return len(handlers) > 0
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a/b/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+", "a", false},
+		{"+/b", "a/b", true},
+		{"+/+", "a/b", true},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+		{"#", "a", true},
+		{"#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "b", false},
+		{"a/#/c", "a/b/c", false},
+		{"#", "$SYS/broker", false},
+		{"+/broker", "$SYS/broker", false},
+		{"$SYS/#", "$SYS/broker", true},
+		{"$aws/things/+/shadow/update", "$aws/things/blid/shadow/update", true},
+		{"#", "$aws/things/blid/shadow/update", false},
+		{"$share/group/a/+", "a/b", true},
+		{"$share/group", "a", false},
+	}
+	for i := range tests {
+		got := TopicMatch(tests[i].filter, tests[i].topic)
+		if got != tests[i].match {
+			t.Errorf("TopicMatch(%q, %q) = %t, want %t", tests[i].filter, tests[i].topic, got, tests[i].match)
+		}
+	}
+}
+
+func TestTopicRouter(t *testing.T) {
+	router := TopicRouter{}
+	received := map[string]int{}
+	handler := func(name string) SubscribeHandleFunction {
+		return func(topic string, payload []byte) {
+			received[name+" "+topic]++
+		}
+	}
+
+	if !router.Add("a/#", handler("first")) {
+		t.Error("first handler of a/# is not new")
+	}
+	if router.Add("a/#", handler("second")) {
+		t.Error("second handler of a/# is new")
+	}
+	if !router.Add("a/+", handler("plus")) {
+		t.Error("first handler of a/+ is not new")
+	}
+
+	if !router.Route("a/b", nil) {
+		t.Error("a/b not routed")
+	}
+	if !router.Route("a", nil) {
+		t.Error("a not routed to a/#")
+	}
+	if router.Route("b", nil) {
+		t.Error("b routed")
+	}
+	for _, key := range []string{"first a/b", "second a/b", "plus a/b", "first a", "second a"} {
+		if received[key] != 1 {
+			t.Errorf("%s received %d times, want 1", key, received[key])
+		}
+	}
+	if received["plus a"] != 0 {
+		t.Error("a routed to a/+")
+	}
+
+	if !router.Remove("a/#") {
+		t.Error("a/# not removed")
+	}
+	if router.Remove("a/#") {
+		t.Error("a/# removed twice")
+	}
+	if len(router.Filters()) != 1 || router.Filters()[0] != "a/+" {
+		t.Errorf("filters %v, want [a/+]", router.Filters())
+	}
+	received = map[string]int{}
+	router.Route("a/b", nil)
+	if received["first a/b"] != 0 || received["second a/b"] != 0 || received["plus a/b"] != 1 {
+		t.Errorf("after remove received %v", received)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"github.com/rs/zerolog/log"
+)
+
+// Robot events published as Home Assistant device triggers, the subtype is
+// the name shown in the automation editor
+var robot_events = []struct {
+	Id      string
+	Subtype string
+}{
+	{"mission_started", "Mission started"},
+	{"mission_completed", "Mission completed"},
+	{"mission_cancelled", "Mission cancelled"},
+	{"bin_full", "Bin full"},
+	{"stuck", "Stuck"},
+	{"tank_empty", "Tank empty"},
+	{"pad_changed", "Pad changed"},
+	{"docked", "Docked"},
+	{"evacuation_finished", "Evacuation finished"},
+}
+
+func (self *HomeAssistant) ConfigureTrigger(device_id string, trigger_id string, subtype string, dev *Device) *Trigger {
+	return_value := &Trigger{
+		Entity: Entity{
+			HomeAssistant: self,
+			Component:     "device_automation",
+			DeviceId:      device_id,
+			ObjectId:      trigger_id,
+			Attributes:    make(map[string]interface{}),
+		},
+		Config: TriggerConfig{
+			AutomationType: "trigger",
+			Type:           "event",
+			Subtype:        subtype,
+			Payload:        trigger_id,
+			Device:         dev,
+		},
+	}
+	return_value.ConfigTopic = self.DiscoveryTopic(&return_value.Entity)
+	return_value.SetBaseTopic(self.EntityTopic(&return_value.Entity))
+
+	self.Entities = append(self.Entities, return_value)
+	return_value.NeedSendConfig = true
+
+	return return_value
+}
+
+// ConfigureTriggers add a device trigger per robot event
+func (self *HomeAssistant) ConfigureTriggers(device_id string, dev *Device) {
+	self.Triggers = map[string]*Trigger{}
+	for i := range robot_events {
+		self.Triggers[robot_events[i].Id] = self.ConfigureTrigger(device_id, robot_events[i].Id, robot_events[i].Subtype, dev)
+	}
+}
+
+// Fire publish an event, events are not retained
+func (self *Trigger) Fire() {
+	log.Info().Str("robot", self.DeviceId).Str("event", self.ObjectId).Msg("Robot event")
+	err := self.HomeAssistant.MasterMqttClient.Publish(self.Config.Topic, []byte(self.Config.Payload), global_qos_value, false)
+	if err != nil {
+		log.Warn().Err(err).Str("topic", self.Config.Topic).Msg("Robot event")
+	}
+}
+
+// FireEvents fire the triggers of the events
+func (self *HomeAssistant) FireEvents(events []string) {
+	if self.RobotId == "" {
+		return
+	}
+	for i := range events {
+		if trigger, ok := self.Triggers[events[i]]; ok {
+			trigger.Fire()
+		}
+	}
+}
+
+// RobotEvents derive the robot events from the transitions of the reported
+// state, nothing is fired until the previous value is known
+type RobotEvents struct {
+	phase      string
+	cycle      string
+	pad        string
+	bin_known  bool
+	bin_full   bool
+	tank_known bool
+	tank_lvl   int
+}
+
+func missionCycle(cycle string) bool {
+	return cycle != "" && cycle != "none" && cycle != "dock" && cycle != "evac"
+}
+
+// Update return the events of a message received from the robot
+func (self *RobotEvents) Update(reported Reported) []string {
+	events := []string{}
+
+	if status := reported.CleanMissionStatus; status != nil {
+		if self.phase != "" {
+			if !missionCycle(self.cycle) && missionCycle(status.Cycle) {
+				events = append(events, "mission_started")
+			}
+			if missionCycle(self.cycle) && !missionCycle(status.Cycle) {
+				if self.phase == "stop" || status.Phase == "stop" {
+					events = append(events, "mission_cancelled")
+				} else {
+					events = append(events, "mission_completed")
+				}
+			}
+			if status.Phase == "stuck" && self.phase != "stuck" {
+				events = append(events, "stuck")
+			}
+			if status.Phase == "charge" && self.phase != "charge" && self.phase != "evac" {
+				events = append(events, "docked")
+			}
+			if self.phase == "evac" && status.Phase != "evac" {
+				events = append(events, "evacuation_finished")
+			}
+		}
+		self.phase = status.Phase
+		self.cycle = status.Cycle
+	}
+
+	if reported.Bin != nil {
+		if self.bin_known && !self.bin_full && reported.Bin.Full {
+			events = append(events, "bin_full")
+		}
+		self.bin_known = true
+		self.bin_full = reported.Bin.Full
+	}
+
+	if reported.TankLvl != nil {
+		if self.tank_known && self.tank_lvl > 0 && *reported.TankLvl == 0 {
+			events = append(events, "tank_empty")
+		}
+		self.tank_known = true
+		self.tank_lvl = *reported.TankLvl
+	}
+
+	if reported.DetectedPad != nil {
+		if self.pad != "" && *reported.DetectedPad != self.pad {
+			events = append(events, "pad_changed")
+		}
+		self.pad = *reported.DetectedPad
+	}
+
+	return events
+}
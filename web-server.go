@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The web UI control the robots, it only listen on the loopback unless
+// HTTP_ADDRESS say otherwise, e.g. :8080 in a container
+var HTTP_ADDRESS = "127.0.0.1:8080"
+
+var content_types map[string]string = map[string]string{
+	"png": "image/png",
+	"svg": "image/svg+xml",
+}
+
+func FindClient(roomba_id string) *Client {
+	for i := range vacuum_client_list {
+		if vacuum_client_list[i].LockedId() == roomba_id {
+			return vacuum_client_list[i]
+		}
+	}
+	return nil
+}
+
+func WriteJson(w http.ResponseWriter, status int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// MissionMapHandler serve the mission maps
+//
+//	/maps/<blid>                   list of the missions on disk
+//	/maps/<blid>/<mission>.<ext>   rendered map, mission can be latest or current
+func MissionMapHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/maps/"), "/"), "/")
+
+	client := FindClient(parts[0])
+	if client == nil {
+		http.NotFound(w, r)
+		return
+	}
+	// the loop create the recorder when the robot reports its blid
+	client.mutex.Lock()
+	missions := client.Missions
+	client.mutex.Unlock()
+	if missions == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(parts) == 1 {
+		WriteJson(w, http.StatusOK, missions.List())
+		return
+	}
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	idx := strings.LastIndex(parts[1], ".")
+	if idx < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	ext := parts[1][idx+1:]
+	data, err := missions.Read(parts[1][:idx], ext)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", content_types[ext])
+	w.Write(data)
+}
+
+func StartWebServer(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", IndexHandler)
+	mux.HandleFunc("/robots/", RobotHandler)
+	mux.HandleFunc("/pairing", PairingHandler)
+	mux.HandleFunc("/debug/", DebugHandler)
+	mux.HandleFunc("/maps/", MissionMapHandler)
+	mux.HandleFunc("/api/robots", ApiRobotsHandler)
+	mux.HandleFunc("/api/robots/", ApiRobotHandler)
+	mux.HandleFunc("/metrics", MetricsHandler)
+
+	// health endpoints are not protected, orchestrators query them
+	root := http.NewServeMux()
+	root.HandleFunc("/healthz", HealthzHandler)
+	root.HandleFunc("/readyz", ReadyzHandler)
+	root.Handle("/", BasicAuth(mux))
+
+	if HTTP_USER == "" && HTTP_PASSWORD == "" && !isLoopback(address) {
+		log.Warn().Str("address", address).Msg("HTTP server reachable from the network without HTTP_USER and HTTP_PASSWORD")
+	}
+
+	go func() {
+		log.Info().Str("address", address).Msg("HTTP server listening")
+		err := http.ListenAndServe(address, root)
+		if err != nil {
+			log.Error().Err(err).Msg("HTTP server")
+		}
+	}()
+}
+
+// isLoopback tell if a listen address only accept local connections
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// sameOrigin tell if a form post comes from a page of the web UI. Browsers
+// send the Origin, or at least the Referer, of a cross-site post, a request
+// without any is refused. Behind a reverse proxy the Host header must be
+// forwarded.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
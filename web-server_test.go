@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIsLoopback(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1:8080":   true,
+		"localhost:8080":   true,
+		"[::1]:8080":       true,
+		":8080":            false,
+		"0.0.0.0:8080":     false,
+		"192.168.1.2:8080": false,
+		"8080":             false,
+	}
+	for address, loopback := range tests {
+		if got := isLoopback(address); got != loopback {
+			t.Errorf("isLoopback(%q) = %t, want %t", address, got, loopback)
+		}
+	}
+}
+
+// TestSameOrigin check that the web UI only accept the form posts of its own
+// pages
+func TestSameOrigin(t *testing.T) {
+	tests := []struct {
+		origin  string
+		referer string
+		allowed bool
+	}{
+		{"http://example.com", "", true},
+		{"", "http://example.com/robots/" + test_blid, true},
+		{"http://evil.test", "", false},
+		{"http://evil.test", "http://example.com/", false},
+		{"null", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodPost, "/pairing", strings.NewReader("address=10.0.0.1"))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.origin != "" {
+			request.Header.Set("Origin", test.origin)
+		}
+		if test.referer != "" {
+			request.Header.Set("Referer", test.referer)
+		}
+		if got := sameOrigin(request); got != test.allowed {
+			t.Errorf("origin %q referer %q: %t, want %t", test.origin, test.referer, got, test.allowed)
+		}
+		if test.allowed {
+			continue
+		}
+		recorder := httptest.NewRecorder()
+		PairingHandler(recorder, request)
+		if recorder.Code != http.StatusForbidden {
+			t.Errorf("origin %q referer %q: pairing status %d, want 403", test.origin, test.referer, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var HTTP_USER = ""
+var HTTP_PASSWORD = ""
+
+type RegionView struct {
+	Id   string
+	Name string
+	Type string
+}
+
+type MapView struct {
+	Id      string
+	Name    string
+	Regions []RegionView
+}
+
+type RobotView struct {
+	Id          string
+	Name        string
+	Address     string
+	Connected   bool
+	LastMessage time.Time
+	State       string
+	Battery     int
+	Error       interface{}
+	Maps        []MapView
+	Missions    []string
+	Shadow      string
+	DebugFiles  []string
+}
+
+type PairingView struct {
+	Address   string
+	Discovery *RobotDiscovery
+	Password  string
+	Error     string
+}
+
+var web_ui_templates = template.Must(template.New("layout").Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>roomba2mqtt</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+pre { background: #f4f4f4; padding: 1em; overflow: auto; max-height: 30em; }
+.online { color: #2ea043; } .offline { color: #d63333; }
+form.inline { display: inline; }
+</style>
+</head>
+<body>
+<h1><a href="/">roomba2mqtt</a></h1>
+<p><a href="/">Robots</a> | <a href="/pairing">Pairing</a></p>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "index"}}{{template "header"}}
+<h2>Robots</h2>
+<table>
+<tr><th>Name</th><th>Blid</th><th>Address</th><th>Connection</th><th>State</th><th>Battery</th><th>Last message</th></tr>
+{{range .}}<tr>
+<td><a href="/robots/{{.Id}}">{{.Name}}</a></td>
+<td>{{.Id}}</td>
+<td>{{.Address}}</td>
+<td>{{if .Connected}}<span class="online">connected</span>{{else}}<span class="offline">disconnected</span>{{end}}</td>
+<td>{{.State}}{{with .Error}} ({{.}}){{end}}</td>
+<td>{{.Battery}}%</td>
+<td>{{if not .LastMessage.IsZero}}{{.LastMessage.Format "2006-01-02 15:04:05"}}{{end}}</td>
+</tr>{{end}}
+</table>
+{{template "footer"}}{{end}}
+
+{{define "robot"}}{{template "header"}}
+<h2>{{.Name}} <small>{{.Id}}</small></h2>
+<p>{{if .Connected}}<span class="online">connected</span>{{else}}<span class="offline">disconnected</span>{{end}}
+to {{.Address}}, state <b>{{.State}}</b>{{with .Error}} ({{.}}){{end}}, battery {{.Battery}}%</p>
+
+<h3>Commands</h3>
+{{$id := .Id}}
+<form class="inline" method="post" action="/robots/{{$id}}/command"><button name="command" value="start">Start</button></form>
+<form class="inline" method="post" action="/robots/{{$id}}/command"><button name="command" value="pause">Pause</button></form>
+<form class="inline" method="post" action="/robots/{{$id}}/command"><button name="command" value="stop">Stop</button></form>
+<form class="inline" method="post" action="/robots/{{$id}}/command"><button name="command" value="return_to_base">Dock</button></form>
+<form class="inline" method="post" action="/robots/{{$id}}/command"><button name="command" value="evacuate">Empty bin</button></form>
+<form class="inline" method="post" action="/robots/{{$id}}/command"><button name="command" value="rooms">Clean selected regions</button></form>
+
+<h3>Maps and regions</h3>
+{{range $m := .Maps}}
+<h4>{{$m.Name}} <small>{{$m.Id}}</small></h4>
+<table>
+<tr><th>Region</th><th>Type</th><th>Name</th></tr>
+{{range $m.Regions}}<tr>
+<td>{{.Id}}</td><td>{{.Type}}</td>
+<td><form method="post" action="/robots/{{$id}}/rename">
+<input type="hidden" name="map_id" value="{{$m.Id}}">
+<input type="hidden" name="region_id" value="{{.Id}}">
+<input name="name" value="{{.Name}}"> <button>Rename</button>
+</form></td>
+</tr>{{end}}
+</table>
+{{else}}<p>No map known yet.</p>{{end}}
+
+<h3>Missions</h3>
+{{if .Missions}}<p><img src="/maps/{{.Id}}/latest.png" alt="latest mission"></p>
+<ul>{{range .Missions}}<li>{{.}} <a href="/maps/{{$id}}/{{.}}.png">png</a> <a href="/maps/{{$id}}/{{.}}.svg">svg</a></li>{{end}}</ul>
+{{else}}<p>No mission recorded yet.</p>{{end}}
+
+<h3>Debug</h3>
+{{if .DebugFiles}}<ul>{{range .DebugFiles}}<li><a href="/debug/{{$id}}/{{.}}">{{.}}</a></li>{{end}}</ul>{{else}}<p>No debug capture.</p>{{end}}
+
+<h3>Reported state</h3>
+<pre>{{.Shadow}}</pre>
+{{template "footer"}}{{end}}
+
+{{define "pairing"}}{{template "header"}}
+<h2>Pairing</h2>
+<p>Place the robot on its dock and hold the home button for 2 seconds until it beeps, then submit its IP address.</p>
+<form method="post" action="/pairing">
+<input name="address" placeholder="192.168.1.10" value="{{.Address}}"> <button>Get password</button>
+</form>
+{{with .Error}}<p class="offline">{{.}}</p>{{end}}
+{{if .Password}}
+<table>
+{{with .Discovery}}<tr><th>Name</th><td>{{.RobotName}}</td></tr>
+<tr><th>SKU</th><td>{{.Sku}}</td></tr>
+<tr><th>Blid (ROOMBA_USER)</th><td>{{.Blid}}</td></tr>{{end}}
+<tr><th>Password (ROOMBA_PASSWORD)</th><td>{{.Password}}</td></tr>
+</table>
+{{end}}
+{{template "footer"}}{{end}}
+`))
+
+func (self *Client) View() RobotView {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return_value := RobotView{
+		Id:          self.Id(),
+		Name:        self.HomeAssistant.Vacuum.Config.Name,
+		Address:     self.MqttConfig.Broker,
+		Connected:   self.Connected,
+		LastMessage: self.LastMessage,
+		State:       self.HomeAssistant.Vacuum.State.State,
+		Battery:     self.HomeAssistant.Vacuum.State.BatteryLevel,
+		Error:       self.HomeAssistant.Vacuum.Attributes["error"],
+		Maps:        []MapView{},
+		Missions:    []string{},
+	}
+
+	for m := range self.Maps {
+		map_view := MapView{
+			Id:      self.Maps[m].Id,
+			Name:    self.Maps[m].Name,
+			Regions: []RegionView{},
+		}
+		for _, region := range self.Maps[m].Regions {
+			map_view.Regions = append(map_view.Regions, RegionView{
+				Id:   region.Id,
+				Name: region.Name,
+				Type: region.Type,
+			})
+		}
+		sort.Slice(map_view.Regions, func(i, j int) bool {
+			return map_view.Regions[i].Id < map_view.Regions[j].Id
+		})
+		return_value.Maps = append(return_value.Maps, map_view)
+	}
+
+	if self.Missions != nil {
+		return_value.Missions = self.Missions.List()
+	}
+
+	data, _ := json.MarshalIndent(self.Shadow, "", "  ")
+	return_value.Shadow = string(data)
+
+	if self.Capture != nil {
+		return_value.DebugFiles = self.Capture.Files()
+	}
+
+	return return_value
+}
+
+func RenderTemplate(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := web_ui_templates.ExecuteTemplate(w, name, data)
+	if err != nil {
+		log.Error().Err(err).Str("template", name).Msg("HTTP render")
+	}
+}
+
+func IndexHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	robots := []RobotView{}
+	for i := range vacuum_client_list {
+		robots = append(robots, vacuum_client_list[i].View())
+	}
+	RenderTemplate(w, "index", robots)
+}
+
+// RobotHandler serve the robot pages, the posts must come from the web UI
+//
+//	/robots/<blid>           status page
+//	/robots/<blid>/command   POST command=<start|stop|pause|return_to_base|evacuate|rooms>
+//	/robots/<blid>/rename    POST map_id, region_id, name
+func RobotHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/robots/"), "/"), "/")
+
+	client := FindClient(parts[0])
+	if client == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(parts) == 1 {
+		RenderTemplate(w, "robot", client.View())
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+
+	switch parts[1] {
+	case "command":
+		if !client.IsConnected() {
+			http.Error(w, "robot is not connected", http.StatusServiceUnavailable)
+			return
+		}
+		command := r.FormValue("command")
+		log.Info().Str("roomba", client.LockedId()).Str("command", command).Msg("HTTP command")
+		// some commands wait on the robot, do not block the request
+		client.Loop.Queue(RobotCommand{Command: command})
+	case "rename":
+		var err error
+		client.Loop.Call(func() {
+			err = client.RenameRegion(r.FormValue("map_id"), r.FormValue("region_id"), strings.TrimSpace(r.FormValue("name")))
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	http.Redirect(w, r, "/robots/"+client.LockedId(), http.StatusSeeOther)
+}
+
+func PairingHandler(w http.ResponseWriter, r *http.Request) {
+	view := PairingView{}
+	if r.Method == http.MethodPost {
+		if !sameOrigin(r) {
+			http.Error(w, "cross-origin request", http.StatusForbidden)
+			return
+		}
+		view.Address = strings.TrimSpace(r.FormValue("address"))
+		discovery, err := DiscoverRobot(view.Address)
+		if err == nil {
+			view.Discovery = &discovery
+		} else {
+			log.Warn().Err(err).Str("address", view.Address).Msg("Robot discovery")
+		}
+		view.Password, err = GetRobotPassword(view.Address)
+		if err != nil {
+			view.Error = err.Error()
+		}
+	}
+	RenderTemplate(w, "pairing", view)
+}
+
+// DebugHandler serve the debug captures
+//
+//	/debug/<blid>          most recent capture
+//	/debug/<blid>/<file>   capture file listed by Capture.Files, e.g. <blid>.jsonl.1
+func DebugHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/debug/"), "/"), "/")
+	client := FindClient(parts[0])
+	if client == nil || client.Capture == nil || len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	files := client.Capture.Files()
+	if len(files) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	name := files[0]
+	if len(parts) == 2 {
+		name = parts[1]
+	}
+	file_name := client.Capture.Path(name)
+	if file_name == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"\"")
+	http.ServeFile(w, r, file_name)
+}
+
+// BasicAuth protect the handler when HTTP_USER and HTTP_PASSWORD are set
+func BasicAuth(handler http.Handler) http.Handler {
+	if HTTP_USER == "" && HTTP_PASSWORD == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(HTTP_USER)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(HTTP_PASSWORD)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="roomba2mqtt"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}